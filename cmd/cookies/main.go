@@ -1,41 +1,118 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	stdjson "encoding/json"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
-	"log"
+	"io/fs"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 
+	"github.com/x1m3/corona/frontend"
+	"github.com/x1m3/corona/internal/admin"
 	"github.com/x1m3/corona/internal/bots"
+	"github.com/x1m3/corona/internal/codec"
+	"github.com/x1m3/corona/internal/codec/compact"
 	"github.com/x1m3/corona/internal/codec/json"
+	"github.com/x1m3/corona/internal/codec/msgpack"
+	"github.com/x1m3/corona/internal/config"
+	"github.com/x1m3/corona/internal/connlimit"
 	"github.com/x1m3/corona/internal/corona"
+	"github.com/x1m3/corona/internal/logger"
 	"github.com/x1m3/corona/internal/messages"
+	"github.com/x1m3/corona/internal/metrics"
+	"github.com/x1m3/corona/internal/recording"
 )
 
-const (
-	updateClientPeriod         = 100 * time.Millisecond
-	pixels2Meters              = 10
-	gameWidthMeters            = 2000
-	gameHeightMeters           = 2000
-	virtualHost                = ""
-	port                       = 8000
-	serverHTTPReadTimeOut      = 10 * time.Second // Maximum time to read the full http request
-	serverHTTPWriteTimeout     = 10 * time.Second // Maximum time to write the full http request
-	serverHTTPKeepAliveTimeout = 5 * time.Second  // Keep alive timeout. Time to close an idle connection if keep alive is enable
-)
+// codecs that clients can negotiate, in order of preference. The first one is
+// used if the client does not ask for any.
+var codecs = []codec.MarshalUnmarshaler{json.Codec, msgpack.Codec, compact.Codec}
 
 var game *corona.Game
+var conf *config.Config
+var log = logger.Default()
+var assets fs.FS
+var bans = admin.NewBanList()
+var limiter *connlimit.Limiter
 
 func main() {
+	var err error
+
+	conf, err = config.Load(os.Args[0], os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Error("Invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	if conf.PrintOnly {
+		_, _ = conf.WriteTo(os.Stdout)
+		return
+	}
+	log = conf.Logger(os.Stderr)
+	log.Info("Effective configuration", "config", conf)
+
+	game = corona.New(corona.Config{
+		Width:              conf.Game.Width,
+		Height:             conf.Game.Height,
+		UpdateClientPeriod: conf.Game.UpdateClientPeriod,
+		MinFPS:             conf.Game.MinFPS,
+		MaxFPS:             conf.Game.MaxFPS,
+		Speed:              conf.Game.Speed,
+		TurboSpeed:         conf.Game.TurboSpeed,
+		MinFoodCount:       conf.Game.MinFoodCount,
+		KeyframePeriod:     conf.Game.KeyframePeriod,
+		DeltaThreshold:     conf.Game.DeltaThreshold,
+		OutboxSize:         conf.Game.OutboxSize,
+		OutboxMaxOverflow:  conf.Game.OutboxMaxOverflow,
+		PingPeriod:         conf.Game.PingPeriod,
+		ResumeGrace:        conf.Game.ResumeGrace,
+		ResumeSecret:       []byte(conf.Game.ResumeSecret),
+		Batch:              conf.Game.Batch,
+		Logger:             log,
+	})
+
+	limiter = connlimit.New(connlimit.Config{
+		AllowedOrigins: conf.AllowedOrigins(),
+		MaxConnsPerIP:  conf.Server.MaxConnsPerIP,
+		UpgradeRate:    conf.Server.UpgradeRate,
+		UpgradeBurst:   conf.Server.UpgradeBurst,
+	})
+
+	if conf.Server.RecordDir != "" {
+		if err := os.MkdirAll(conf.Server.RecordDir, 0755); err != nil {
+			log.Error("Cannot create recording directory", "dir", conf.Server.RecordDir, "err", err)
+			os.Exit(1)
+		}
+	}
 
-	game = corona.New(gameWidthMeters, gameHeightMeters, updateClientPeriod)
+	botsCodec, found := codec.Lookup(conf.Bots.Codec, codecs...)
+	if !found {
+		log.Error("Unknown bots codec", "codec", conf.Bots.Codec)
+		os.Exit(1)
+	}
+	botsManager := bots.NewManager(game, conf.Bots.Count, conf.Bots.SpawnPeriod, botsCodec)
+
+	assets = frontend.Assets(conf.Server.AssetsDir)
+	static, err := fs.Sub(assets, "static")
+	if err != nil {
+		log.Error("Cannot load static files", "assets_dir", conf.Server.AssetsDir, "err", err)
+		os.Exit(1)
+	}
 
 	router := &mux.Router{}
 	router.NotFoundHandler = func() http.HandlerFunc {
@@ -47,37 +124,114 @@ func main() {
 	}()
 	router.HandleFunc("/", indexAction).Methods("GET")
 	router.HandleFunc("/ws/", wsAction).Methods("GET")
-	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static/")))).Methods("GET")
+	router.HandleFunc("/healthz", healthAction((*corona.Health).Live)).Methods("GET")
+	router.HandleFunc("/readyz", healthAction((*corona.Health).Ready)).Methods("GET")
+	if conf.Server.MetricsPath != "" {
+		router.Handle(conf.Server.MetricsPath, metrics.Default).Methods("GET")
+	}
+	if conf.Admin.Token != "" {
+		router.PathPrefix("/admin/").Handler(admin.NewHandler(conf.Admin.Token, game, botsManager, bans, log.With("component", "admin")))
+	}
+	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.FS(static)))).Methods("GET")
 
 	server := &http.Server{
-		Addr:         fmt.Sprintf("%s:%d", virtualHost, port),
+		Addr:         fmt.Sprintf("%s:%d", conf.Server.Host, conf.Server.Port),
 		Handler:      router,
-		ReadTimeout:  serverHTTPReadTimeOut,
-		WriteTimeout: serverHTTPWriteTimeout,
-		IdleTimeout:  serverHTTPKeepAliveTimeout,
+		ReadTimeout:  conf.Server.ReadTimeout,
+		WriteTimeout: conf.Server.WriteTimeout,
+		IdleTimeout:  conf.Server.KeepAliveTimeout,
+	}
+
+	done := make(chan struct{})
+	var redirectServer *http.Server
+	if conf.TLS() {
+		certs, err := newCertReloader(conf.Server.TLSCertFile, conf.Server.TLSKeyFile)
+		if err != nil {
+			log.Error("Cannot load TLS certificate", "cert_file", conf.Server.TLSCertFile, "err", err)
+			os.Exit(1)
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}
+		if conf.Server.TLSReloadPeriod > 0 {
+			go certs.watch(conf.Server.TLSReloadPeriod, done)
+		}
+		go reloadOnSIGHUP(certs, done)
+
+		if conf.Server.RedirectPort != 0 {
+			redirectServer = &http.Server{
+				Addr:         fmt.Sprintf("%s:%d", conf.Server.Host, conf.Server.RedirectPort),
+				Handler:      redirectHandler(conf.Server.Port),
+				ReadTimeout:  conf.Server.ReadTimeout,
+				WriteTimeout: conf.Server.WriteTimeout,
+				IdleTimeout:  conf.Server.KeepAliveTimeout,
+			}
+		}
 	}
 
-	go game.Init()
-	log.Println("Starting Server")
+	game.Init()
+	log.Info("Starting server", "addr", server.Addr, "tls", conf.TLS())
 
-	botsManager := bots.NewManager(game)
 	go botsManager.Init()
 
+	if conf.Server.PprofAddr != "" {
+		go func() {
+			log.Warn("Pprof server stopped", "err", http.ListenAndServe(conf.Server.PprofAddr, nil))
+		}()
+	}
+
 	go func() {
-		log.Println(http.ListenAndServe("localhost:6060", nil))
+		var err error
+		if conf.TLS() {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Error("Server stopped", "err", err)
+			os.Exit(1)
+		}
 	}()
 
-	server.ListenAndServe()
+	if redirectServer != nil {
+		log.Info("Redirecting to HTTPS", "addr", redirectServer.Addr)
+		go func() {
+			if err := redirectServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Error("Redirect server stopped", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+	log.Info("Shutting down", "signal", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Server.ShutdownTimeout)
+	defer cancel()
+
+	close(done)
+	botsManager.Stop()
+	if redirectServer != nil {
+		if err := redirectServer.Shutdown(ctx); err != nil {
+			log.Error("Error shutting down redirect server", "err", err)
+		}
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Error("Error shutting down http server", "err", err)
+	}
+	if err := game.Shutdown(ctx); err != nil {
+		log.Error("Error shutting down game", "err", err)
+	}
+	log.Info("Server stopped")
 }
 
 func indexAction(resp http.ResponseWriter, req *http.Request) {
 
 	home := "templates/index.tpl.html"
-	index, err := template.ParseFiles(home)
+	index, err := template.ParseFS(assets, home)
 	if err != nil {
 		resp.WriteHeader(http.StatusInternalServerError)
-		cwd, _ := os.Getwd()
-		log.Printf("Error loading index. <working_dir:%s> <Error:%s", cwd, err.Error())
+		log.Error("Error loading index", "assets_dir", conf.Server.AssetsDir, "err", err)
 		resp.Header().Set("Content-Type", "text/html")
 		_, _ = resp.Write([]byte("Error loading url"))
 		return
@@ -86,102 +240,147 @@ func indexAction(resp http.ResponseWriter, req *http.Request) {
 	resp.Header().Set("Content-Type", "text/html")
 
 	tplData := struct {
+		WebsocketScheme    string
 		UpdateClientPeriod float64
 		PixelsToMeters     int
 		GameWidth          int
 		GameHeight         int
+		MessageTypes       map[string]int
+		MinProtocolVersion int
+		ProtocolVersion    int
+		Capabilities       []string
 	}{
-		UpdateClientPeriod: float64(updateClientPeriod) / float64(time.Second),
-		PixelsToMeters:     pixels2Meters,
-		GameWidth:          gameWidthMeters,
-		GameHeight:         gameHeightMeters,
+		WebsocketScheme:    websocketScheme(req),
+		UpdateClientPeriod: float64(conf.Game.UpdateClientPeriod) / float64(time.Second),
+		PixelsToMeters:     conf.Game.PixelsToMeters,
+		GameWidth:          int(conf.Game.Width),
+		GameHeight:         int(conf.Game.Height),
+		MessageTypes:       messages.Types(),
+		MinProtocolVersion: messages.MinProtocolVersion,
+		ProtocolVersion:    messages.ProtocolVersion,
+		Capabilities:       messages.Capabilities(),
 	}
 
 	index.Execute(resp, &tplData)
 }
 
-func wsAction(resp http.ResponseWriter, req *http.Request) {
-	upgrader := websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin:     func(r *http.Request) bool { return true },
+// healthAction returns a handler that reports the game health as JSON, with
+// status 503 if check fails.
+func healthAction(check func(*corona.Health, time.Duration) error) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		report := struct {
+			Status string `json:"status"`
+			Error  string `json:"error,omitempty"`
+			*corona.Health
+		}{Status: "ok", Health: game.Health()}
+
+		status := http.StatusOK
+		if err := check(report.Health, conf.Server.MaxTickAge); err != nil {
+			status = http.StatusServiceUnavailable
+			report.Status, report.Error = "fail", err.Error()
+			log.Warn("Health check failed", "path", req.URL.Path, "err", err)
+		}
+
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Header().Set("Cache-Control", "no-store")
+		resp.WriteHeader(status)
+		_ = stdjson.NewEncoder(resp).Encode(&report)
 	}
-	conn, err := upgrader.Upgrade(resp, req, nil)
-	if err != nil {
-		log.Println(err)
+}
+
+// wsAction upgrades the connection to a websocket. The codec is negotiated
+// using the websocket subprotocol, or the "codec" query parameter if the client
+// does not send any.
+func wsAction(resp http.ResponseWriter, req *http.Request) {
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil && bans.Banned(ip) {
+		log.Info("Rejected connection from banned address", "remote", ip)
+		http.Error(resp, "Forbidden", http.StatusForbidden)
 		return
 	}
 
-	sessionID, responses, endOfGame := game.NewSession()
-
-	transport := corona.NewTransport(json.Codec, corona.NewWebsocketConnection(conn))
-
-	go handleWSRequests(transport, sessionID)
-
-	go manageRemoteView(transport, sessionID, responses, endOfGame)
-
-	log.Println("New Connection")
-}
+	names := make([]string, 0, len(codecs))
+	for _, c := range codecs {
+		names = append(names, c.Name())
+	}
 
-func manageRemoteView(transport *corona.Transport, sessionID uint64, responses chan interface{}, endOfGame chan interface{}) {
-	for {
-		select {
-		case req, ok := <-responses:
-			if !ok {
-				return
-			}
-			if err := transport.Send(req.(messages.Message)); err != nil {
-				log.Printf("Socket broken while writing. Closing connection. Err:<%v>", err)
-				game.Logout(sessionID)
-				transport.Close()
-				return
-			}
-		case _, ok := <-endOfGame:
-			if !ok {
-				return
-			}
+	queryCodec := codecs[0]
+	if name := req.URL.Query().Get("codec"); name != "" {
+		var found bool
+		if queryCodec, found = codec.Lookup(name, codecs...); !found {
+			http.Error(resp, fmt.Sprintf("unsupported codec <%s>", name), http.StatusBadRequest)
+			return
 		}
 	}
-}
 
-func handleWSRequests(transport *corona.Transport, sessionID uint64) {
-	var resp messages.Message
-	var errResp error
+	release, err := limiter.Admit(req)
+	switch err {
+	case nil:
+	case connlimit.ErrOrigin:
+		log.Warn("Rejected websocket", "remote", req.RemoteAddr, "origin", req.Header.Get("Origin"), "err", err)
+		http.Error(resp, "Forbidden", http.StatusForbidden)
+		return
+	default:
+		log.Warn("Rejected websocket", "remote", req.RemoteAddr, "err", err)
+		http.Error(resp, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
 
-	for {
-		msg, err := transport.Receive()
-		if err != nil {
-			log.Printf("Closing conection. Err:<%v>", err)
-			game.Logout(sessionID)
-			transport.Close()
-			return
-		}
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		Subprotocols:      names,
+		CheckOrigin:       func(r *http.Request) bool { return true }, // Checked by limiter.Admit
+		EnableCompression: conf.Server.Compression,
+	}
+	conn, err := upgrader.Upgrade(corona.CountingResponseWriter(resp), req, nil)
+	if err != nil {
+		release()
+		log.Warn("Cannot upgrade connection", "remote", req.RemoteAddr, "err", err)
+		return
+	}
 
-		errResp = nil
-		resp = nil
+	c, found := codec.Lookup(conn.Subprotocol(), codecs...)
+	if !found {
+		c = queryCodec
+	}
+	_ = conn.SetCompressionLevel(conf.Server.CompressionLevel)
+	wsConn := corona.NewWebsocketConnection(conn, codec.IsBinary(c), conf.Server.CompressionMin)
 
-		switch msg.GetType() {
-		case messages.ViewPortRequestType:
-			game.UpdateViewPortRequest(sessionID, msg.(*messages.ViewPortRequest))
+	sessionID, outbox := game.NewSession()
+	connLog := log.With("session", sessionID)
+	if err := game.SetSessionCodec(sessionID, c.Name()); err != nil {
+		connLog.Error("Error setting session codec", "err", err)
+	}
+	if err := game.SetSessionRemoteAddr(sessionID, req.RemoteAddr); err != nil {
+		connLog.Error("Error setting session remote address", "err", err)
+	}
+	if err := game.SetSessionTraffic(sessionID, wsConn); err != nil {
+		connLog.Error("Error setting session traffic counter", "err", err)
+	}
 
-		case messages.UserJoinRequestType: // join user
-			resp, errResp = game.UserJoin(sessionID, msg.(*messages.UserJoinRequest))
+	var transportConn corona.Connection = wsConn
+	if conf.Server.RecordDir != "" {
+		transportConn = recordConnection(wsConn, c.Name(), sessionID, connLog)
+	}
+	transport := corona.NewTransport(c, transportConn, connLog.With("component", "transport"))
 
-		case messages.CreateCookieRequestType:
-			resp, errResp = game.CreateCookie(sessionID, msg.(*messages.CreateCookieRequest))
+	go func() {
+		defer release()
+		game.Serve(sessionID, outbox, transport, connLog)
+	}()
 
-		default:
-			log.Printf("got unknown message type <%v>", msg)
-		}
+	connLog.Info("New connection", "codec", c.Name(), "remote", req.RemoteAddr)
+}
 
-		if errResp != nil {
-			log.Printf("Error: <%s>", err)
-			continue
-		}
-		if resp != nil {
-			if err := transport.Send(resp); err != nil {
-				log.Printf("Error sending response, Err:<%v>", err)
-			}
-		}
+// recordConnection returns conn recording its frames to a file in the
+// recording directory, or conn itself if the file cannot be created.
+func recordConnection(conn corona.Connection, codecName string, sessionID uint64, log *logger.Logger) corona.Connection {
+	name := filepath.Join(conf.Server.RecordDir, fmt.Sprintf("%s-%d.jsonl", time.Now().UTC().Format("20060102T150405"), sessionID))
+	f, err := os.Create(name)
+	if err != nil {
+		log.Error("Cannot record session", "err", err)
+		return conn
 	}
+	log.Info("Recording session", "file", name)
+	return recording.NewConnection(conn, codecName, f, log)
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certReloader serves a certificate that is loaded again from disk when the
+// files change, so renewed certificates are used without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the certificate and key files. The current certificate is
+// kept if they cannot be loaded.
+func (r *certReloader) reload() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate: %v", err)
+	}
+
+	r.Lock()
+	r.cert, r.modTime = &cert, modTime
+	r.Unlock()
+	return nil
+}
+
+// reloadIfModified loads the files again if any of them changed since the
+// last load. It returns true if the certificate was replaced.
+func (r *certReloader) reloadIfModified() (bool, error) {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return false, err
+	}
+
+	r.RLock()
+	changed := !modTime.Equal(r.modTime)
+	r.RUnlock()
+	if !changed {
+		return false, nil
+	}
+	return true, r.reload()
+}
+
+func (r *certReloader) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return last, fmt.Errorf("checking certificate: %v", err)
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
+
+// watch checks the files every period until done is closed.
+func (r *certReloader) watch(period time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		reloaded, err := r.reloadIfModified()
+		if err != nil {
+			log.Error("Cannot reload TLS certificate", "cert_file", r.certFile, "err", err)
+			continue
+		}
+		if reloaded {
+			log.Info("TLS certificate reloaded", "cert_file", r.certFile)
+		}
+	}
+}
+
+// reloadOnSIGHUP loads the certificate again every time the process gets a
+// SIGHUP, until done is closed.
+func reloadOnSIGHUP(r *certReloader, done chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-done:
+			return
+		case <-hup:
+		}
+		if err := r.reload(); err != nil {
+			log.Error("Cannot reload TLS certificate", "cert_file", r.certFile, "err", err)
+			continue
+		}
+		log.Info("TLS certificate reloaded", "cert_file", r.certFile)
+	}
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.cert, nil
+}
+
+// redirectHandler sends every request to the same url on https and port.
+func redirectHandler(port int) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = strings.Trim(req.Host, "[]")
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		target := *req.URL
+		target.Scheme, target.Host = "https", host
+		http.Redirect(resp, req, target.String(), http.StatusMovedPermanently)
+	})
+}
+
+// websocketScheme returns the scheme clients must use to open the websocket
+// from a page served by req.
+func websocketScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "wss"
+	}
+	return "ws"
+}
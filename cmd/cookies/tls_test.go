@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeCert(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	assert.NoError(t, os.Chtimes(certFile, modTime, modTime))
+	assert.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+}
+
+func commonName(t *testing.T, r *certReloader) string {
+	cert, err := r.GetCertificate(nil)
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	now := time.Now()
+	writeCert(t, certFile, keyFile, "first", now.Add(-time.Minute))
+
+	r, err := newCertReloader(certFile, keyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", commonName(t, r))
+
+	reloaded, err := r.reloadIfModified()
+	assert.NoError(t, err)
+	assert.False(t, reloaded)
+
+	writeCert(t, certFile, keyFile, "second", now)
+	reloaded, err = r.reloadIfModified()
+	assert.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, "second", commonName(t, r))
+
+	// A broken file keeps the last good certificate.
+	assert.NoError(t, ioutil.WriteFile(keyFile, []byte("garbage"), 0600))
+	assert.Error(t, r.reload())
+	assert.Equal(t, "second", commonName(t, r))
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		port     int
+		host     string
+		expected string
+	}{
+		{port: 8443, host: "cookies.io:8080", expected: "https://cookies.io:8443/ws/?codec=json"},
+		{port: 443, host: "cookies.io", expected: "https://cookies.io/ws/?codec=json"},
+		{port: 443, host: "[::1]:80", expected: "https://[::1]/ws/?codec=json"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://"+test.host+"/ws/?codec=json", nil)
+		resp := httptest.NewRecorder()
+		redirectHandler(test.port).ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusMovedPermanently, resp.Code)
+		assert.Equal(t, test.expected, resp.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,247 @@
+// Command replay sends the frames a client sent in a session recorded with
+// server.record-dir to a fresh game, and prints the differences between the
+// messages the game sent then and now, leaving out the fields that change on
+// every run, as session IDs. It exits with status 1 if they differ.
+//
+//	replay [flags] recording.jsonl
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/x1m3/corona/internal/codec"
+	"github.com/x1m3/corona/internal/codec/compact"
+	jsoncodec "github.com/x1m3/corona/internal/codec/json"
+	"github.com/x1m3/corona/internal/codec/msgpack"
+	"github.com/x1m3/corona/internal/corona"
+	"github.com/x1m3/corona/internal/logger"
+	"github.com/x1m3/corona/internal/messages"
+	"github.com/x1m3/corona/internal/recording"
+)
+
+var codecs = []codec.MarshalUnmarshaler{jsoncodec.Codec, msgpack.Codec, compact.Codec}
+
+func main() {
+	speed := flag.Float64("speed", 1, "replay speed. 1 keeps the recorded timing, 0 sends frames as fast as possible")
+	settle := flag.Duration("settle", time.Second, "time waiting for responses after the last frame")
+	ignore := flag.String("ignore", "ViewPortResponse,Ping,StatsResponse", "comma separated message types left out of the diff, as they depend on timing")
+	level := flag.String("log-level", "warn", "game log level: debug, info, warn or error")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] recording.jsonl\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	logLevel, err := logger.ParseLevel(*level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	log := logger.New(os.Stderr, logLevel, logger.TextFormat)
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	frames, err := recording.Read(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot read recording:", err)
+		os.Exit(2)
+	}
+	if len(frames) == 0 {
+		fmt.Fprintln(os.Stderr, "Empty recording")
+		os.Exit(2)
+	}
+	c, found := codec.Lookup(frames[0].Codec, codecs...)
+	if !found {
+		fmt.Fprintf(os.Stderr, "Unknown codec <%s>\n", frames[0].Codec)
+		os.Exit(2)
+	}
+
+	cfg := corona.DefaultConfig()
+	cfg.Logger = log
+	game := corona.New(cfg)
+	game.Init()
+
+	replayed := replay(game, c, frames, *speed, *settle, log)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := game.Shutdown(ctx); err != nil {
+		log.Error("Error shutting down game", "err", err)
+	}
+	cancel()
+
+	ignored := make(map[string]bool)
+	for _, name := range strings.Split(*ignore, ",") {
+		ignored[strings.TrimSpace(name)] = true
+	}
+	changed := false
+	for _, line := range diff(describe(c, frames, ignored), describe(c, replayed, ignored)) {
+		changed = changed || !strings.HasPrefix(line, " ")
+		fmt.Println(line)
+	}
+	if changed {
+		os.Exit(1)
+	}
+}
+
+// replay sends the inbound frames to a new session of game, and returns the
+// frames the game sends back until settle after the last one.
+func replay(game *corona.Game, c codec.MarshalUnmarshaler, frames []*recording.Frame, speed float64, settle time.Duration, log *logger.Logger) []*recording.Frame {
+	server, client := corona.Pipe()
+	sessionID, outbox := game.NewSession()
+	log = log.With("session", sessionID)
+	if err := game.SetSessionCodec(sessionID, c.Name()); err != nil {
+		log.Error("Error setting session codec", "err", err)
+	}
+	go game.Serve(sessionID, outbox, corona.NewTransport(c, server, log.With("component", "transport")), log)
+
+	var mu sync.Mutex
+	replayed := make([]*recording.Frame, 0)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			data, err := client.ReadMessage()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			replayed = append(replayed, &recording.Frame{Time: time.Now(), Direction: recording.Out, Codec: c.Name(), Data: data})
+			mu.Unlock()
+		}
+	}()
+
+	var last time.Time
+	for _, frame := range frames {
+		if frame.Direction != recording.In {
+			continue
+		}
+		if !last.IsZero() && speed > 0 {
+			time.Sleep(time.Duration(float64(frame.Time.Sub(last)) / speed))
+		}
+		last = frame.Time
+		if err := client.WriteMessage(frame.Data); err != nil {
+			log.Warn("Connection closed by the game before the end of the recording", "err", err)
+			break
+		}
+	}
+
+	time.Sleep(settle)
+	client.Close()
+	wg.Wait()
+	return replayed
+}
+
+// describe returns a line for every message sent in the outbound frames, with
+// its type and content, leaving out the ignored types.
+func describe(c codec.MarshalUnmarshaler, frames []*recording.Frame, ignored map[string]bool) []string {
+	lines := make([]string, 0, len(frames))
+	for _, frame := range frames {
+		if frame.Direction != recording.Out {
+			continue
+		}
+		msg, err := corona.Decode(c, frame.Data)
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("undecodable frame: %v", err))
+			continue
+		}
+		msgs := []messages.Message{msg}
+		// Batching depends on timing, so only the messages in a batch are compared.
+		if batch, ok := msg.(*messages.Batch); ok {
+			if msgs, err = corona.Unbatch(c, batch); err != nil {
+				lines = append(lines, fmt.Sprintf("undecodable batch: %v", err))
+				continue
+			}
+		}
+		for _, msg := range msgs {
+			// Decoded messages are always registered.
+			r, _ := messages.Lookup(msg.GetType())
+			if ignored[r.Name] {
+				continue
+			}
+			normalize(msg)
+			data, _ := json.Marshal(msg)
+			lines = append(lines, r.Name+" "+string(data))
+		}
+	}
+	return lines
+}
+
+// normalize blanks the fields that change on every run of a session, as the
+// session ID, that is also the ID of its cookie, the resume tokens and the
+// position where the cookie is spawned.
+func normalize(msg messages.Message) {
+	switch m := msg.(type) {
+	case *messages.UserJoinResponse:
+		if m.Data.ResumeToken != "" {
+			m.Data.ResumeToken = "*"
+		}
+	case *messages.CreateCookieResponse:
+		m.Data.ID, m.Data.X, m.Data.Y = 0, 0, 0
+	case *messages.ResumeResponse:
+		if m.Data.ResumeToken != "" {
+			m.Data.ResumeToken = "*"
+		}
+		m.Data.Cookie.ID, m.Data.Cookie.X, m.Data.Cookie.Y = 0, 0, 0
+	}
+}
+
+// diff returns the lines of a and b, prefixed with "- " if they are only in
+// a, "+ " if they are only in b, or "  " if they are in both.
+func diff(a, b []string) []string {
+	// Longest common subsequence of the suffixes of a and b.
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	lines := make([]string, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, "  "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, "- "+a[i])
+			i++
+		default:
+			lines = append(lines, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, "+ "+b[j])
+	}
+	return lines
+}
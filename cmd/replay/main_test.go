@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/x1m3/corona/internal/codec/json"
+	"github.com/x1m3/corona/internal/corona"
+	"github.com/x1m3/corona/internal/logger"
+	"github.com/x1m3/corona/internal/messages"
+	"github.com/x1m3/corona/internal/recording"
+)
+
+func TestDiff(t *testing.T) {
+	assert.Equal(t,
+		[]string{"  a", "- b", "+ x", "  c", "+ d"},
+		diff([]string{"a", "b", "c"}, []string{"a", "x", "c", "d"}))
+	assert.Empty(t, diff(nil, nil))
+}
+
+func TestReplay(t *testing.T) {
+	cfg := corona.DefaultConfig()
+	cfg.Logger = logger.Nop()
+	game := corona.New(cfg)
+
+	join, err := json.Codec.Marshal(&messages.Envelope{Type: messages.UserJoinRequestType, Data: messages.NewUserJoinRequest("manolo")})
+	assert.NoError(t, err)
+	frames := []*recording.Frame{{Time: time.Now(), Direction: recording.In, Codec: "json", Data: join}}
+
+	replayed := replay(game, json.Codec, frames, 0, 100*time.Millisecond, logger.Nop())
+	lines := describe(json.Codec, replayed, map[string]bool{"Ping": true})
+	assert.Len(t, lines, 1)
+	assert.Contains(t, lines[0], "UserJoinResponse")
+}
+
+func TestReplay_NoDiff(t *testing.T) {
+	record := func(frames []*recording.Frame) []*recording.Frame {
+		cfg := corona.DefaultConfig()
+		cfg.Logger = logger.Nop()
+		game := corona.New(cfg)
+		game.Init()
+		defer game.Shutdown(context.Background())
+		return replay(game, json.Codec, frames, 0, 200*time.Millisecond, logger.Nop())
+	}
+
+	join, err := json.Codec.Marshal(&messages.Envelope{Type: messages.UserJoinRequestType, Data: messages.NewUserJoinRequest("manolo")})
+	assert.NoError(t, err)
+	create, err := json.Codec.Marshal(&messages.Envelope{Type: messages.CreateCookieRequestType, Data: messages.NewCreateCookieRequest()})
+	assert.NoError(t, err)
+	frames := []*recording.Frame{
+		{Time: time.Now(), Direction: recording.In, Codec: "json", Data: join},
+		{Time: time.Now(), Direction: recording.In, Codec: "json", Data: create},
+	}
+	recorded := append(frames, record(frames)...)
+
+	ignored := map[string]bool{"ViewPortResponse": true, "Ping": true, "StatsResponse": true}
+	expected := describe(json.Codec, recorded, ignored)
+	assert.Len(t, expected, 2)
+	for _, line := range diff(expected, describe(json.Codec, record(frames), ignored)) {
+		assert.True(t, strings.HasPrefix(line, " "), line)
+	}
+}
@@ -0,0 +1,22 @@
+// Package frontend bundles the web client served by the cookies server, so the
+// server binary does not depend on the working directory.
+package frontend
+
+import (
+	"embed"
+	"io/fs"
+	"os"
+)
+
+//go:embed templates static
+var embedded embed.FS
+
+// Assets returns the frontend files, with the templates under "templates/" and
+// the static files under "static/". If dir is not empty, files are read from
+// that directory instead of the bundled ones. Useful while developing the client.
+func Assets(dir string) fs.FS {
+	if dir != "" {
+		return os.DirFS(dir)
+	}
+	return embedded
+}
@@ -0,0 +1,20 @@
+package frontend
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssets(t *testing.T) {
+	for _, dir := range []string{"", "."} {
+		assets := Assets(dir)
+
+		_, err := fs.Stat(assets, "templates/index.tpl.html")
+		assert.NoError(t, err, dir)
+
+		_, err = fs.Stat(assets, "static/js/transport.js")
+		assert.NoError(t, err, dir)
+	}
+}
@@ -1,21 +1,28 @@
-const ViewPortRequestType = 1;
-const ViewPortResponseType = 2;
-const UserJoinRequestType = 3;
-const UserJoinResponseType = 4;
-const CreateCookieRequestType = 5;
-const CreateCookieResponseType= 6;
-const StatsResponseType = 7;
+// MessageTypes is set by the server from its message registry. Every type is
+// exposed as <Name>Type, like ViewPortRequestType.
+for (const name in MessageTypes) {
+    window[name + "Type"] = MessageTypes[name];
+}
 
+// ProtocolVersion and Capabilities are the protocol spoken by this client. A
+// stale cached copy may not match the server, whose range is in ServerProtocol.
+const ProtocolVersion = 1;
+const Capabilities = ["delta", "ping", "resume", "batch"];
 
+if (ProtocolVersion < ServerProtocol.min || ProtocolVersion > ServerProtocol.max) {
+    console.warn("Client protocol version " + ProtocolVersion + " not supported by the server, that speaks " + ServerProtocol.min + " to " + ServerProtocol.max);
+}
 
-function ViewPortRequest(x, y, xx, yy, angle, turbo) {
+// ack is the last viewport frame applied. resync asks for a full frame. seq
+// numbers the input, acknowledged by the server in viewport responses.
+function ViewPortRequest(x, y, xx, yy, angle, turbo, ack, resync, seq) {
     this.t = ViewPortRequestType;
-    this.d = {X:x, Y:y, XX:xx, YY:yy, R:angle, T:turbo}
+    this.d = {X:x, Y:y, XX:xx, YY:yy, R:angle, T:turbo, A:ack, RS:resync, S:seq}
 };
 
 function UserJoinRequest(username) {
     this.t = UserJoinRequestType;
-    this.d = {UN:username};
+    this.d = {UN:username, V:ProtocolVersion, CP:Capabilities};
 };
 
 function UserJoinResponse(ok, altNames) {
@@ -27,4 +34,14 @@ function UserJoinResponse(ok, altNames) {
 function CreateCookieRequest() {
     this.t = CreateCookieRequestType;
     this.d = null;
-}
\ No newline at end of file
+}
+
+function Pong(id) {
+    this.t = PongType;
+    this.d = {I:id};
+}
+
+function ResumeRequest(token) {
+    this.t = ResumeRequestType;
+    this.d = {RT:token};
+}
@@ -1,18 +1,30 @@
 function JSONMarshalUnmarshal() {
+    this.name = "json";
+    this.binary = false;
     this.encode = function(obj) {
         return JSON.stringify(obj);
     };
     this.decode = function(buffer) {
         return JSON.parse(buffer);
     };
+    // The messages of a batch are base64 encoded JSON.
+    this.decodeBatched = function(item) {
+        var bytes = Uint8Array.from(atob(item), function (c) { return c.charCodeAt(0); });
+        return JSON.parse(new TextDecoder().decode(bytes));
+    };
 }
 
 function MsgPackMarshalUnmarshal() {
+    this.name = "msgpack";
+    this.binary = true;
     this.encode = function(obj) {
         return msgpack.encode(obj);
     };
     this.decode = function(buffer) {
-        return msgpack.decode(buffer);
+        return msgpack.decode(new Uint8Array(buffer));
+    };
+    this.decodeBatched = function(item) {
+        return msgpack.decode(item);
     };
 
 }
@@ -20,22 +32,71 @@ function MsgPackMarshalUnmarshal() {
 function Transport(wsUrl, coder) {
     var _this = this;
     this.coder = coder;
-    this.conn = new WebSocket(wsUrl);
     this.callbacks = new Map();
 
-    this.conn.onopen = function () {
-        console.log("socket is open")
-    };
+    // Pings are answered here. rtt and jitter are the ones measured by the server, in milliseconds.
+    this.rtt = 0;
+    this.jitter = 0;
+    this.callbacks.set(PingType, function (msg) {
+        _this.rtt = msg.RTT;
+        _this.jitter = msg.J;
+        _this.send(new Pong(msg.I));
+    });
 
-    this.conn.onmessage = function (e) {
-        rawMsg = _this.coder.decode(e.data);
-        fn = _this.callbacks.get(rawMsg.t);
-        fn(rawMsg);
-    };
+    // Failed requests are logged, unless a callback is registered for ErrorResponseType.
+    // msg.C is a stable code, msg.M a message for humans and msg.R the type of the request.
+    this.callbacks.set(ErrorResponseType, function (msg) {
+        console.warn("Request " + msg.R + " failed: " + msg.C + ". " + msg.M);
+    });
+
+    // Requests sent with request() carry an ID, echoed by the server on the
+    // response. latencies keeps the last response time of every request type, in milliseconds.
+    this.nextRequestID = 1;
+    this.pending = new Map();
+    this.latencies = new Map();
+
+    // resumeToken is set once the user joins. If the connection drops, a new
+    // one is opened to resume the session with it.
+    this.resumeToken = null;
+
+    this.connect = function () {
+        // The codec is negotiated using the websocket subprotocol
+        _this.conn = new WebSocket(wsUrl, [coder.name]);
+        if (coder.binary) {
+            _this.conn.binaryType = "arraybuffer";
+        }
+
+        _this.conn.onopen = function () {
+            console.log("socket is open");
+            _this.pending.clear();
+            if (_this.resumeToken !== null) {
+                _this.request(new ResumeRequest(_this.resumeToken));
+            }
+        };
 
-    this.conn.onerror = function (e) {
-        console.log("we have a network error");
+        _this.conn.onmessage = function (e) {
+            var rawMsg = _this.coder.decode(e.data);
+            if (rawMsg.t !== BatchType) {
+                _this.dispatch(rawMsg);
+                return;
+            }
+            for (var i = 0; i < rawMsg.M.length; i++) {
+                _this.dispatch(_this.coder.decodeBatched(rawMsg.M[i]));
+            }
+        };
+
+        _this.conn.onerror = function (e) {
+            console.log("we have a network error");
+        };
+
+        _this.conn.onclose = function (e) {
+            if (_this.resumeToken !== null) {
+                console.log("socket closed, resuming");
+                window.setTimeout(_this.connect, 1000);
+            }
+        };
     };
+    this.connect();
 
     this.send = function(msg) {
         if (_this.conn.readyState === _this.conn.OPEN) {
@@ -43,6 +104,26 @@ function Transport(wsUrl, coder) {
         }
     };
 
+    this.dispatch = function(rawMsg) {
+        if (rawMsg.RQ && _this.pending.has(rawMsg.RQ)) {
+            var req = _this.pending.get(rawMsg.RQ);
+            _this.pending.delete(rawMsg.RQ);
+            _this.latencies.set(req.t, Date.now() - req.sent);
+        }
+        var fn = _this.callbacks.get(rawMsg.t);
+        if (fn) {
+            fn(rawMsg);
+        }
+    };
+
+    // request sends a message with a new request ID.
+    this.request = function(msg) {
+        var id = _this.nextRequestID++;
+        msg.d = Object.assign({}, msg.d, {RQ: id});
+        _this.pending.set(id, {t: msg.t, sent: Date.now()});
+        _this.send(msg);
+    };
+
     this.registerCallback = function(msgType, fn) {
         _this.callbacks.set(msgType, fn)
     }
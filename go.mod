@@ -1,6 +1,6 @@
 module github.com/x1m3/corona
 
-go 1.14
+go 1.16
 
 require (
 	github.com/ByteArena/box2d v1.0.2
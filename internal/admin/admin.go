@@ -0,0 +1,235 @@
+// Package admin contains an HTTP API to inspect and manage a running game.
+// All requests must be authenticated with an "Authorization: Bearer <token>" header.
+//
+//	GET    /admin/sessions             List sessions
+//	DELETE /admin/sessions/{id}        Kick a session
+//	POST   /admin/sessions/{id}/ban    Ban the address of a session and kick it
+//	PUT    /admin/sessions/{id}/score  Set the score of a session. Body: {"score": 200}
+//	GET    /admin/bans                 List banned addresses
+//	DELETE /admin/bans/{ip}            Remove a ban
+//	POST   /admin/food                 Throw food. Body: {"count": 100, "x": 500, "y": 500}
+//	GET    /admin/params               Get runtime parameters
+//	PUT    /admin/params               Change runtime parameters. Body: {"min_food_count": 3000, "bots": 10}
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/x1m3/corona/internal/corona"
+	"github.com/x1m3/corona/internal/logger"
+)
+
+// Bots controls the number of bots playing.
+type Bots interface {
+	SetCount(n int)
+	Count() (max int, running int)
+}
+
+type Params struct {
+	MinFoodCount *uint64 `json:"min_food_count,omitempty"`
+	Bots         *int    `json:"bots,omitempty"`
+	BotsRunning  *int    `json:"bots_running,omitempty"`
+}
+
+type scoreRequest struct {
+	Score uint64 `json:"score"`
+}
+
+type foodRequest struct {
+	Count int     `json:"count"`
+	X     float64 `json:"x"`
+	Y     float64 `json:"y"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type Handler struct {
+	log    *logger.Logger
+	token  []byte
+	game   *corona.Game
+	bots   Bots
+	bans   *BanList
+	router *mux.Router
+}
+
+// NewHandler returns the admin API handler. token must not be empty.
+func NewHandler(token string, game *corona.Game, bots Bots, bans *BanList, log *logger.Logger) *Handler {
+	h := &Handler{log: log, token: []byte(token), game: game, bots: bots, bans: bans, router: mux.NewRouter()}
+
+	h.router.HandleFunc("/admin/sessions", h.listSessions).Methods("GET")
+	h.router.HandleFunc("/admin/sessions/{id:[0-9]+}", h.kickSession).Methods("DELETE")
+	h.router.HandleFunc("/admin/sessions/{id:[0-9]+}/ban", h.banSession).Methods("POST")
+	h.router.HandleFunc("/admin/sessions/{id:[0-9]+}/score", h.setScore).Methods("PUT")
+	h.router.HandleFunc("/admin/bans", h.listBans).Methods("GET")
+	h.router.HandleFunc("/admin/bans/{ip}", h.unban).Methods("DELETE")
+	h.router.HandleFunc("/admin/food", h.spawnFood).Methods("POST")
+	h.router.HandleFunc("/admin/params", h.getParams).Methods("GET")
+	h.router.HandleFunc("/admin/params", h.setParams).Methods("PUT")
+
+	return h
+}
+
+func (h *Handler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if !h.authorized(req) {
+		h.log.Warn("Unauthorized admin request", "remote", req.RemoteAddr, "method", req.Method, "path", req.URL.Path)
+		h.writeJSON(resp, http.StatusUnauthorized, &errorResponse{Error: "unauthorized"})
+		return
+	}
+	h.router.ServeHTTP(resp, req)
+}
+
+func (h *Handler) authorized(req *http.Request) bool {
+	const prefix = "Bearer "
+	auth := req.Header.Get("Authorization")
+	if len(h.token) == 0 || !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, prefix)), h.token) == 1
+}
+
+func (h *Handler) listSessions(resp http.ResponseWriter, req *http.Request) {
+	h.writeJSON(resp, http.StatusOK, h.game.Sessions())
+}
+
+func (h *Handler) kickSession(resp http.ResponseWriter, req *http.Request) {
+	id, ok := h.sessionID(resp, req)
+	if !ok {
+		return
+	}
+	if err := h.game.Kick(id); err != nil {
+		h.writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	h.log.Info("Admin kicked session", "session", id)
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) banSession(resp http.ResponseWriter, req *http.Request) {
+	id, ok := h.sessionID(resp, req)
+	if !ok {
+		return
+	}
+	session, err := h.game.Session(id)
+	if err != nil {
+		h.writeError(resp, http.StatusNotFound, err)
+		return
+	}
+	ip, _, err := net.SplitHostPort(session.RemoteAddr)
+	if err != nil {
+		h.writeError(resp, http.StatusConflict, fmt.Errorf("session <%d> has no remote address", id))
+		return
+	}
+
+	h.bans.Ban(ip)
+	if err := h.game.Kick(id); err != nil {
+		h.writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	h.log.Info("Admin banned session", "session", id, "ip", ip)
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) setScore(resp http.ResponseWriter, req *http.Request) {
+	var body scoreRequest
+
+	id, ok := h.sessionID(resp, req)
+	if !ok {
+		return
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		h.writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	if err := h.game.SetScore(id, body.Score); err != nil {
+		h.writeError(resp, http.StatusNotFound, err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) listBans(resp http.ResponseWriter, req *http.Request) {
+	h.writeJSON(resp, http.StatusOK, h.bans.List())
+}
+
+func (h *Handler) unban(resp http.ResponseWriter, req *http.Request) {
+	h.bans.Unban(mux.Vars(req)["ip"])
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) spawnFood(resp http.ResponseWriter, req *http.Request) {
+	var body foodRequest
+
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		h.writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	if err := h.game.SpawnFood(body.Count, body.X, body.Y); err != nil {
+		h.writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	resp.WriteHeader(http.StatusAccepted)
+}
+
+func (h *Handler) getParams(resp http.ResponseWriter, req *http.Request) {
+	minFood := h.game.MinFoodCount()
+	max, running := h.bots.Count()
+	h.writeJSON(resp, http.StatusOK, &Params{MinFoodCount: &minFood, Bots: &max, BotsRunning: &running})
+}
+
+func (h *Handler) setParams(resp http.ResponseWriter, req *http.Request) {
+	var body Params
+
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		h.writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	if body.Bots != nil && *body.Bots < 0 {
+		h.writeError(resp, http.StatusBadRequest, fmt.Errorf("bots cannot be negative"))
+		return
+	}
+
+	if body.MinFoodCount != nil {
+		h.game.SetMinFoodCount(*body.MinFoodCount)
+	}
+	if body.Bots != nil {
+		h.bots.SetCount(*body.Bots)
+	}
+	max, _ := h.bots.Count()
+	h.log.Info("Admin changed params", "min_food_count", h.game.MinFoodCount(), "bots", max)
+	h.getParams(resp, req)
+}
+
+func (h *Handler) sessionID(resp http.ResponseWriter, req *http.Request) (uint64, bool) {
+	id, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
+	if err != nil {
+		h.writeError(resp, http.StatusBadRequest, err)
+		return 0, false
+	}
+	if _, err := h.game.Session(id); err != nil {
+		h.writeError(resp, http.StatusNotFound, err)
+		return 0, false
+	}
+	return id, true
+}
+
+func (h *Handler) writeError(resp http.ResponseWriter, status int, err error) {
+	h.writeJSON(resp, status, &errorResponse{Error: err.Error()})
+}
+
+func (h *Handler) writeJSON(resp http.ResponseWriter, status int, v interface{}) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	if err := json.NewEncoder(resp).Encode(v); err != nil {
+		h.log.Error("Error writing admin response", "err", err)
+	}
+}
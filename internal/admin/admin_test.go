@@ -0,0 +1,82 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/x1m3/corona/internal/corona"
+	"github.com/x1m3/corona/internal/logger"
+	"github.com/x1m3/corona/internal/messages"
+)
+
+const token = "secret"
+
+type fakeBots struct {
+	count int
+}
+
+func (b *fakeBots) SetCount(n int) {
+	b.count = n
+}
+
+func (b *fakeBots) Count() (int, int) {
+	return b.count, 0
+}
+
+func request(h http.Handler, method, path, body, auth string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if auth != "" {
+		req.Header.Set("Authorization", "Bearer "+auth)
+	}
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestHandler(t *testing.T) {
+	game := corona.New(corona.DefaultConfig())
+	bans := NewBanList()
+	h := NewHandler(token, game, &fakeBots{}, bans, logger.Nop())
+
+	sessionID, _ := game.NewSession()
+	_, err := game.UserJoin(sessionID, messages.NewUserJoinRequest("manolo"))
+	assert.NoError(t, err)
+	assert.NoError(t, game.SetSessionRemoteAddr(sessionID, "10.0.0.1:4567"))
+
+	assert.Equal(t, http.StatusUnauthorized, request(h, "GET", "/admin/sessions", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, request(h, "GET", "/admin/sessions", "", "wrong").Code)
+
+	resp := request(h, "GET", "/admin/sessions", "", token)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var sessions []*corona.SessionInfo
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&sessions))
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, "manolo", sessions[0].Username)
+	assert.Equal(t, "logged", sessions[0].State)
+
+	path := fmt.Sprintf("/admin/sessions/%d", sessionID)
+	assert.Equal(t, http.StatusNoContent, request(h, "PUT", path+"/score", `{"score": 1234}`, token).Code)
+	s, err := game.Session(sessionID)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1234), s.Score)
+
+	assert.Equal(t, http.StatusNoContent, request(h, "POST", path+"/ban", "", token).Code)
+	assert.True(t, bans.Banned("10.0.0.1"))
+	assert.Equal(t, http.StatusNotFound, request(h, "DELETE", path, "", token).Code)
+
+	assert.Equal(t, http.StatusAccepted, request(h, "POST", "/admin/food", `{"count": 10, "x": 100, "y": 100}`, token).Code)
+	assert.Equal(t, http.StatusBadRequest, request(h, "POST", "/admin/food", `{"count": 10, "x": -1, "y": 100}`, token).Code)
+
+	resp = request(h, "PUT", "/admin/params", `{"min_food_count": 10, "bots": 3}`, token)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, uint64(10), game.MinFoodCount())
+	var params Params
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&params))
+	assert.Equal(t, 3, *params.Bots)
+}
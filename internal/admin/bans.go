@@ -0,0 +1,47 @@
+package admin
+
+import (
+	"sort"
+	"sync"
+)
+
+// BanList is a set of client IP addresses that cannot connect to the game.
+type BanList struct {
+	sync.RWMutex
+	ips map[string]struct{}
+}
+
+func NewBanList() *BanList {
+	return &BanList{ips: make(map[string]struct{})}
+}
+
+func (b *BanList) Ban(ip string) {
+	b.Lock()
+	b.ips[ip] = struct{}{}
+	b.Unlock()
+}
+
+func (b *BanList) Unban(ip string) {
+	b.Lock()
+	delete(b.ips, ip)
+	b.Unlock()
+}
+
+func (b *BanList) Banned(ip string) bool {
+	b.RLock()
+	_, banned := b.ips[ip]
+	b.RUnlock()
+	return banned
+}
+
+// List returns the banned addresses, sorted.
+func (b *BanList) List() []string {
+	b.RLock()
+	ips := make([]string, 0, len(b.ips))
+	for ip := range b.ips {
+		ips = append(ips, ip)
+	}
+	b.RUnlock()
+	sort.Strings(ips)
+	return ips
+}
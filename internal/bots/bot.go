@@ -1,15 +1,23 @@
 package bots
 
 import (
-	"github.com/pkg/errors"
-
-	"log"
+	"sync/atomic"
 	"time"
 
+	"github.com/pkg/errors"
+
+	"github.com/x1m3/corona/internal/codec"
 	"github.com/x1m3/corona/internal/corona"
+	"github.com/x1m3/corona/internal/corona/sessionmanager"
+	"github.com/x1m3/corona/internal/logger"
 	"github.com/x1m3/corona/internal/messages"
 )
 
+// ErrSessionClosed is returned by Run when the game closes the bot session.
+var ErrSessionClosed = errors.New("bot session closed by the game")
+
+var errCookieDestroyed = errors.New("bot cookie destroyed")
+
 type BotAgent interface {
 	Join() *messages.UserJoinRequest
 	JoinResponse(response *messages.UserJoinResponse)
@@ -21,66 +29,194 @@ type BotAgent interface {
 
 type Bot struct {
 	game      *corona.Game
+	log       *logger.Logger
 	agent     BotAgent
+	codec     codec.MarshalUnmarshaler
 	sessionID uint64
-	responses chan interface{}
+	server    corona.Connection // end of the pipe served by the game
+	transport *corona.Transport
 	ticker    *time.Ticker
-	endOfGame chan interface{}
+	destroyed int32
+
+	requestID   uint64 // of the last request, echoed by the game on its response
+	requestSent time.Time
+	inputSeq    uint64 // of the last move
 }
 
-func New(game *corona.Game, bot BotAgent) *Bot {
-	return &Bot{game: game, agent: bot, ticker: time.NewTicker(250 * time.Millisecond)}
+// New returns a bot that plays through an in-memory connection, with messages
+// encoded by c, so it goes through the same path as remote clients.
+func New(game *corona.Game, bot BotAgent, c codec.MarshalUnmarshaler) *Bot {
+	log := game.Logger().With("component", "bot")
+	server, client := corona.Pipe()
+	return &Bot{
+		game:      game,
+		agent:     bot,
+		codec:     c,
+		log:       log,
+		server:    server,
+		transport: corona.NewTransport(c, client, log.With("component", "bot_transport")),
+		ticker:    time.NewTicker(250 * time.Millisecond),
+	}
 }
 
 // Run makes a bot to connect to the game and start playing. It should be
 // called on its own goroutine (go bot.Run() )
 func (b *Bot) Run() error {
-	var resp interface{}
-	var err error
+	defer b.ticker.Stop()
 
-	// Creating a session
-	b.sessionID, b.responses, b.endOfGame = b.game.NewSession()
+	// Creating a session, served as any other connection
+	var outbox *sessionmanager.Outbox
+	b.sessionID, outbox = b.game.NewSession()
+	b.log = b.log.With("session", b.sessionID)
+	if err := b.game.SetSessionCodec(b.sessionID, b.codec.Name()); err != nil {
+		return err
+	}
+	if err := b.game.SetSessionRemoteAddr(b.sessionID, "bot"); err != nil {
+		return err
+	}
+	go b.game.Serve(b.sessionID, outbox, corona.NewTransport(b.codec, b.server, b.log.With("component", "transport")), b.log)
+	defer b.transport.Close()
 
 	// Joining step1
-	resp, err = b.game.UserJoin(b.sessionID, b.agent.Join())
+	if err := b.request(b.join()); err != nil {
+		return b.closed()
+	}
+	resp, err := b.expect(messages.UserJoinResponseType)
 	if err != nil {
-		return err
+		return b.failed(err)
+	}
+	join := resp.(*messages.UserJoinResponse)
+	if !join.Data.Ok {
+		b.destroy()
+		return errors.Errorf("bot join rejected: %s", join.Data.Reason)
 	}
-	b.agent.JoinResponse(resp.(*messages.UserJoinResponse))
+	b.agent.JoinResponse(join)
 
 	// StartPlaying
-	resp, err = b.game.CreateCookie(b.sessionID, b.agent.CreateCookie())
+	if err := b.request(b.agent.CreateCookie()); err != nil {
+		return b.closed()
+	}
+	resp, err = b.expect(messages.CreateCookieResponseType)
 	if err != nil {
-		return err
+		return b.failed(err)
 	}
 	b.agent.CreateCookieResponse(resp.(*messages.CreateCookieResponse))
 
-	b.game.UpdateViewPortRequest(b.sessionID, b.agent.Move())
+	if err := b.move(); err != nil {
+		return b.closed()
+	}
+	for {
+		resp, err := b.expect(messages.ViewPortResponseType)
+		if err != nil {
+			return b.failed(err)
+		}
+		b.agent.UpdateViewWorld(resp.(*messages.ViewportResponse))
+		if err := b.move(); err != nil {
+			return b.closed()
+		}
+	}
+}
 
+// expect returns the next message of type t. Pings are answered, and any
+// other message discarded. Requests that failed are returned as an error.
+func (b *Bot) expect(t int) (messages.Message, error) {
 	for {
-		select {
-		case resp, ok := <-b.responses:
-			if !ok {
-				return errors.New("bla bla bla")
-			}
-			if v, ok := resp.(*messages.ViewportResponse); ok {
-				b.agent.UpdateViewWorld(v)
-				b.game.UpdateViewPortRequest(b.sessionID, b.agent.Move())
+		msg, err := b.transport.Receive()
+		if err != nil {
+			return nil, err
+		}
+		if ping, ok := msg.(*messages.Ping); ok {
+			if err := b.transport.Send(messages.NewPong(ping.ID)); err != nil {
+				return nil, err
 			}
-
-		case <-b.endOfGame:
+			continue
+		}
+		if errResp, ok := msg.(*messages.ErrorResponse); ok {
+			b.answered(errResp)
+			return nil, errResp
+		}
+		// Bots do not play again, they leave the game.
+		if destroyed, ok := msg.(*messages.CookieDestroyed); ok {
+			b.log.Info("Bot cookie destroyed", "killer", destroyed.Data.KillerName, "score", destroyed.Data.Score, "food_eaten", destroyed.Data.FoodEaten)
 			b.destroy()
-			return nil
+			return nil, errCookieDestroyed
+		}
+		if int(msg.GetType()) == t {
+			b.answered(msg)
+			return msg, nil
+		}
+	}
+}
+
+// join returns the join request of the agent. Bots never connect again, so
+// they do not ask for resume tokens.
+func (b *Bot) join() *messages.UserJoinRequest {
+	req := b.agent.Join()
+	capabilities := make([]string, 0, len(req.Capabilities))
+	for _, c := range req.Capabilities {
+		if c != messages.CapabilityResume {
+			capabilities = append(capabilities, c)
 		}
 	}
+	req.Capabilities = capabilities
+	return req
+}
+
+// move sends the next move of the agent, numbered.
+func (b *Bot) move() error {
+	req := b.agent.Move()
+	b.inputSeq++
+	req.Seq = b.inputSeq
+	return b.transport.Send(req)
+}
+
+// request sends a message with a new request ID, to match its response.
+func (b *Bot) request(req messages.Message) error {
+	if c, ok := req.(messages.Correlated); ok {
+		b.requestID++
+		c.SetRequestID(b.requestID)
+		b.requestSent = time.Now()
+	}
+	return b.transport.Send(req)
+}
+
+// answered logs the latency of the last request, if resp is its response.
+func (b *Bot) answered(resp messages.Message) {
+	if c, ok := resp.(messages.Correlated); ok && c.GetRequestID() != 0 && c.GetRequestID() == b.requestID {
+		b.log.Debug("Request answered", "msg_type", resp.GetType(), "request_id", b.requestID, "latency", time.Since(b.requestSent))
+	}
+}
+
+// closed returns the error of Run once the connection is closed, either by
+// the game or by destroy. It is nil if the bot was destroyed.
+func (b *Bot) closed() error {
+	if atomic.LoadInt32(&b.destroyed) == 1 {
+		return nil
+	}
+	return ErrSessionClosed
+}
+
+// failed returns the error of Run when the bot cannot go on. Requests that
+// failed in the game are returned as they are, after leaving it.
+func (b *Bot) failed(err error) error {
+	if errResp, ok := err.(*messages.ErrorResponse); ok {
+		b.destroy()
+		return errResp
+	}
+	return b.closed()
 }
 
 func (b *Bot) destroy() {
+	if !atomic.CompareAndSwapInt32(&b.destroyed, 0, 1) {
+		return
+	}
 	b.ticker.Stop()
-	b.game.Logout(b.sessionID)
-	log.Println("Bot disconnected")
+	// The game closes the session when the connection drops, as for any client.
+	b.transport.Close()
+	b.log.Info("Bot disconnected")
 }
 
+// Destroy removes the bot from the game. Run returns nil.
 func (b *Bot) Destroy() {
-	b.endOfGame <- true
+	b.destroy()
 }
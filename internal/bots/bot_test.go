@@ -7,6 +7,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/x1m3/corona/internal/codec"
+	"github.com/x1m3/corona/internal/codec/compact"
+	"github.com/x1m3/corona/internal/codec/json"
+	"github.com/x1m3/corona/internal/codec/msgpack"
 	"github.com/x1m3/corona/internal/corona"
 	"github.com/x1m3/corona/internal/messages"
 )
@@ -61,28 +65,88 @@ func (a *spyAgent) UpdateViewWorld(w *messages.ViewportResponse) {
 }
 
 func TestBot_Run(t *testing.T) {
-	game := corona.New(1000, 1000, 1*time.Millisecond)
+	cfg := corona.DefaultConfig()
+	cfg.Width, cfg.Height = 1000, 1000
+	cfg.UpdateClientPeriod = 1 * time.Millisecond
+	game := corona.New(cfg)
 	game.Init()
 
-	spy := &spyAgent{}
-	bot := New(game, spy)
+	for _, c := range []codec.MarshalUnmarshaler{json.Codec, msgpack.Codec, compact.Codec} {
+		t.Run(c.Name(), func(t *testing.T) {
+			spy := &spyAgent{}
+			bot := New(game, spy, c)
+
+			done := make(chan error)
+			go func() {
+				done <- bot.Run()
+			}()
+
+			// Let's play the game for some time
+			time.Sleep(time.Second)
+
+			spy.Lock()
+			assert.Equal(t, spy.joinCalls, 1)
+			assert.Equal(t, spy.joinResponseCalls, 1)
+			assert.Equal(t, spy.CreateCookieCalls, 1)
+			assert.Equal(t, spy.CreateCookieResponseCalls, 1)
+
+			assert.NotEqual(t, spy.MoveCalls, 0)
+			assert.NotEqual(t, spy.UpdateViewWorldCalls, 0)
+			spy.Unlock()
+
+			session, err := game.Session(bot.sessionID)
+			assert.NoError(t, err)
+			assert.Equal(t, c.Name(), session.Codec)
+
+			bot.Destroy()
+			select {
+			case err := <-done:
+				assert.NoError(t, err)
+			case <-time.After(time.Second):
+				t.Fatal("bot still running after being destroyed")
+			}
+			assert.Eventually(t, func() bool {
+				_, err := game.Session(bot.sessionID)
+				return err != nil
+			}, time.Second, 10*time.Millisecond, "session closed once the bot disconnects")
+		})
+	}
+
+	// TODO: Do more testing like ensuring cookie is created and it moves.
+}
 
+func TestBot_RunBatched(t *testing.T) {
+	cfg := corona.DefaultConfig()
+	cfg.Width, cfg.Height = 1000, 1000
+	cfg.UpdateClientPeriod = 1 * time.Millisecond
+	cfg.Batch = true
+	game := corona.New(cfg)
+	game.Init()
+
+	spy := &spyAgent{}
+	bot := New(game, spy, compact.Codec)
+	done := make(chan error)
 	go func() {
-		assert.NoError(t, bot.Run())
+		done <- bot.Run()
 	}()
-
-	// Let's play the game for some time
-	time.Sleep(2 * time.Second)
+	time.Sleep(500 * time.Millisecond)
 
 	spy.Lock()
-	assert.Equal(t, spy.joinCalls, 1)
-	assert.Equal(t, spy.joinResponseCalls, 1)
-	assert.Equal(t, spy.CreateCookieCalls, 1)
 	assert.Equal(t, spy.CreateCookieResponseCalls, 1)
-
-	assert.NotEqual(t, spy.MoveCalls, 0)
 	assert.NotEqual(t, spy.UpdateViewWorldCalls, 0)
 	spy.Unlock()
 
-	// TODO: Do more testing like ensuring cookie is created and it moves.
+	bot.Destroy()
+	assert.NoError(t, <-done)
+}
+
+func TestBot_CookieDestroyed(t *testing.T) {
+	game := corona.New(corona.DefaultConfig())
+	bot := New(game, &spyAgent{}, msgpack.Codec)
+	serverTransport := corona.NewTransport(msgpack.Codec, bot.server, game.Logger())
+
+	assert.NoError(t, serverTransport.Send(messages.NewCookieDestroyed(1, "pepe", 120, time.Minute, 3)))
+	_, err := bot.expect(messages.ViewPortResponseType)
+	assert.Error(t, err)
+	assert.NoError(t, bot.failed(err), "the bot leaves the game without error")
 }
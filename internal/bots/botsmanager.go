@@ -1,32 +1,77 @@
 package bots
 
 import (
-	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/x1m3/corona/internal/codec"
 	"github.com/x1m3/corona/internal/corona"
+	"github.com/x1m3/corona/internal/logger"
 )
 
 type Manager struct {
-	game *corona.Game
+	game        *corona.Game
+	codec       codec.MarshalUnmarshaler
+	log         *logger.Logger
+	maxBots     int32
+	running     int32
+	spawnPeriod time.Duration
+	done        chan struct{}
+	stopOnce    sync.Once
 }
 
-func NewManager(g *corona.Game) *Manager {
-	return &Manager{game: g}
+// NewManager returns a manager that keeps up to maxBots bots playing, starting
+// a new one every spawnPeriod while there are less than that. Bots encode
+// their messages with c.
+func NewManager(g *corona.Game, maxBots int, spawnPeriod time.Duration, c codec.MarshalUnmarshaler) *Manager {
+	return &Manager{game: g, codec: c, log: g.Logger().With("component", "bots"), maxBots: int32(maxBots), spawnPeriod: spawnPeriod, done: make(chan struct{})}
 }
 
 func (m *Manager) Init() {
-	t := time.NewTicker(5 * time.Second)
+	t := time.NewTicker(m.spawnPeriod)
+	defer t.Stop()
 	for {
-		<-t.C
+		select {
+		case <-m.done:
+			return
+		case <-t.C:
+		}
+		if atomic.LoadInt32(&m.running) >= atomic.LoadInt32(&m.maxBots) {
+			continue
+		}
+		atomic.AddInt32(&m.running, 1)
 		go func() {
-			bot := New(m.game, NewDummyBotAgent(200, 200))
-			log.Println("Bot started")
+			defer atomic.AddInt32(&m.running, -1)
+
+			bot := New(m.game, NewDummyBotAgent(200, 200), m.codec)
+			m.log.Info("Bot started")
 			if err := bot.Run(); err != nil {
-				log.Println(err)
-				bot.Destroy()
+				m.log.Warn("Bot stopped", "err", err)
+				if err != ErrSessionClosed {
+					bot.Destroy()
+				}
 				return
 			}
 		}()
 	}
 }
+
+// SetCount changes the number of bots that should be playing. Bots over the
+// limit are not removed, but no new ones are started until they finish.
+func (m *Manager) SetCount(n int) {
+	atomic.StoreInt32(&m.maxBots, int32(n))
+}
+
+// Count returns the number of bots that should be playing and the number of bots running.
+func (m *Manager) Count() (max int, running int) {
+	return int(atomic.LoadInt32(&m.maxBots)), int(atomic.LoadInt32(&m.running))
+}
+
+// Stop makes Init return. Bots already playing keep running until the game
+// closes their sessions.
+func (m *Manager) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.done)
+	})
+}
@@ -9,3 +9,25 @@ type MarshalUnmarshaler interface {
 	// name of this codec
 	Name() string
 }
+
+// binary is implemented by codecs whose output is not text.
+type binary interface {
+	Binary() bool
+}
+
+// IsBinary returns true if the data produced by c is not valid text, so it must
+// be sent as binary data (ex: websocket binary frames).
+func IsBinary(c MarshalUnmarshaler) bool {
+	b, ok := c.(binary)
+	return ok && b.Binary()
+}
+
+// Lookup returns the codec in codecs with the given name.
+func Lookup(name string, codecs ...MarshalUnmarshaler) (MarshalUnmarshaler, bool) {
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,27 @@
+package codec_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/x1m3/corona/internal/codec"
+	"github.com/x1m3/corona/internal/codec/compact"
+	"github.com/x1m3/corona/internal/codec/json"
+	"github.com/x1m3/corona/internal/codec/msgpack"
+)
+
+func TestLookup(t *testing.T) {
+	c, found := codec.Lookup("msgpack", json.Codec, msgpack.Codec)
+	assert.True(t, found)
+	assert.Equal(t, msgpack.Codec, c)
+
+	_, found = codec.Lookup("xml", json.Codec, msgpack.Codec)
+	assert.False(t, found)
+}
+
+func TestIsBinary(t *testing.T) {
+	assert.False(t, codec.IsBinary(json.Codec))
+	assert.True(t, codec.IsBinary(msgpack.Codec))
+	assert.True(t, codec.IsBinary(compact.Codec))
+}
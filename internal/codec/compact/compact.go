@@ -0,0 +1,330 @@
+// Package compact contains a binary codec with a hand-written layout for
+// viewport responses, that are the bulk of the traffic. Any other message is
+// encoded with msgpack.
+//
+// Every message starts with a format byte. A viewport is then encoded as its
+// frame, a flags byte, its base frame, tick and input sequence, the velocity
+// of the cookie of the client as two little endian float32 values if the
+// velocity flag is set, the origin (the lowest x and y of all entities) as two
+// more float32 values, the cookies, the food, and the IDs of removed cookies
+// and food. Each entity list is a uvarint count and then
+// the columns of IDs, scores, x and y, each value a uvarint. Positions are
+// quantized to 1/64 meters relative to the origin.
+package compact
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/x1m3/corona/internal/codec/msgpack"
+	"github.com/x1m3/corona/internal/messages"
+)
+
+const name = "compact"
+
+const (
+	formatMsgpack  byte = 0
+	formatViewport byte = 1
+)
+
+const (
+	flagKeyframe byte = 1
+	flagVelocity byte = 2
+)
+
+// scale is the number of quantization steps per meter.
+const scale = 64
+
+var errTruncated = errors.New("compact: truncated message")
+
+// Codec that encodes viewport responses in the compact layout and everything else as msgpack.
+var Codec = new(compactCodec)
+
+type compactCodec int
+
+func (c compactCodec) Marshal(v interface{}) ([]byte, error) {
+	if viewport, ok := v.(*messages.ViewportResponse); ok {
+		return marshalViewport(viewport), nil
+	}
+	data, err := msgpack.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{formatMsgpack}, data...), nil
+}
+
+// Unmarshal decodes b into v. A viewport decoded into any other message, like
+// a *messages.Header, only sets its type.
+func (c compactCodec) Unmarshal(b []byte, v interface{}) error {
+	if len(b) == 0 {
+		return errTruncated
+	}
+	switch b[0] {
+	case formatMsgpack:
+		return msgpack.Codec.Unmarshal(b[1:], v)
+	case formatViewport:
+		switch msg := v.(type) {
+		case *messages.ViewportResponse:
+			return unmarshalViewport(b[1:], msg)
+		case messages.Message:
+			msg.SetType(messages.ViewPortResponseType)
+			return nil
+		}
+		return fmt.Errorf("compact: cannot decode a viewport into <%T>", v)
+	}
+	return fmt.Errorf("compact: unknown format <%d>", b[0])
+}
+
+func (c compactCodec) Name() string {
+	return name
+}
+
+func (c compactCodec) Binary() bool {
+	return true
+}
+
+// entities are the columns of a list of cookies or food.
+type entities struct {
+	ids, scores []uint64
+	xs, ys      []float32
+}
+
+func marshalViewport(v *messages.ViewportResponse) []byte {
+	cookies := entities{}
+	for _, c := range v.Cookies {
+		cookies.append(c.ID, c.Score, c.X, c.Y)
+	}
+	food := entities{}
+	for _, f := range v.Food {
+		food.append(f.ID, f.Score, f.X, f.Y)
+	}
+
+	originX, originY := float32(0), float32(0)
+	if len(cookies.ids)+len(food.ids) > 0 {
+		originX, originY = math.MaxFloat32, math.MaxFloat32
+		for _, e := range []entities{cookies, food} {
+			for i := range e.ids {
+				originX = min32(originX, e.xs[i])
+				originY = min32(originY, e.ys[i])
+			}
+		}
+	}
+
+	// Most values fit in 2 or 3 bytes. IDs are bigger, and food IDs are random.
+	data := make([]byte, 0, 32+len(cookies.ids)*16+len(food.ids)*20+(len(v.RemovedCookies)+len(v.RemovedFood))*10)
+	data = append(data, formatViewport)
+	data = appendUvarint(data, v.Frame)
+	var flags byte
+	if v.Keyframe {
+		flags |= flagKeyframe
+	}
+	if v.VX != 0 || v.VY != 0 {
+		flags |= flagVelocity
+	}
+	data = append(data, flags)
+	data = appendUvarint(data, v.BaseFrame)
+	data = appendUvarint(data, v.Tick)
+	data = appendUvarint(data, v.InputSeq)
+	if flags&flagVelocity != 0 {
+		data = appendFloat32(data, v.VX)
+		data = appendFloat32(data, v.VY)
+	}
+	data = appendFloat32(data, originX)
+	data = appendFloat32(data, originY)
+	data = cookies.marshal(data, originX, originY)
+	data = food.marshal(data, originX, originY)
+	data = appendIDs(data, v.RemovedCookies)
+	data = appendIDs(data, v.RemovedFood)
+	return data
+}
+
+func unmarshalViewport(data []byte, v *messages.ViewportResponse) error {
+	r := &reader{data: data}
+	frame := r.uvarint()
+	flags := r.byte()
+	baseFrame := r.uvarint()
+	tick := r.uvarint()
+	inputSeq := r.uvarint()
+	var vx, vy float32
+	if flags&flagVelocity != 0 {
+		vx = r.float32()
+		vy = r.float32()
+	}
+	originX := r.float32()
+	originY := r.float32()
+
+	var cookies, food entities
+	cookies.unmarshal(r, originX, originY)
+	food.unmarshal(r, originX, originY)
+	removedCookies := r.ids()
+	removedFood := r.ids()
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.data) > 0 {
+		return fmt.Errorf("compact: %d unexpected bytes after viewport", len(r.data))
+	}
+
+	v.SetType(messages.ViewPortResponseType)
+	v.Frame, v.Keyframe, v.BaseFrame = frame, flags&flagKeyframe != 0, baseFrame
+	v.Tick, v.InputSeq, v.VX, v.VY = tick, inputSeq, vx, vy
+	v.RemovedCookies, v.RemovedFood = removedCookies, removedFood
+	v.Cookies = make([]*messages.CookieInfo, len(cookies.ids))
+	for i := range cookies.ids {
+		v.Cookies[i] = &messages.CookieInfo{ID: cookies.ids[i], Score: cookies.scores[i], X: cookies.xs[i], Y: cookies.ys[i]}
+	}
+	v.Food = make([]*messages.FoodInfo, len(food.ids))
+	for i := range food.ids {
+		v.Food[i] = &messages.FoodInfo{ID: food.ids[i], Score: food.scores[i], X: food.xs[i], Y: food.ys[i]}
+	}
+	return nil
+}
+
+func (e *entities) append(id, score uint64, x, y float32) {
+	e.ids = append(e.ids, id)
+	e.scores = append(e.scores, score)
+	e.xs = append(e.xs, x)
+	e.ys = append(e.ys, y)
+}
+
+func (e *entities) marshal(data []byte, originX, originY float32) []byte {
+	data = appendUvarint(data, uint64(len(e.ids)))
+	for _, id := range e.ids {
+		data = appendUvarint(data, id)
+	}
+	for _, score := range e.scores {
+		data = appendUvarint(data, score)
+	}
+	for _, x := range e.xs {
+		data = appendUvarint(data, quantize(x, originX))
+	}
+	for _, y := range e.ys {
+		data = appendUvarint(data, quantize(y, originY))
+	}
+	return data
+}
+
+func (e *entities) unmarshal(r *reader, originX, originY float32) {
+	n := r.uvarint()
+	// Every value takes at least one byte, so it cannot be bigger than this.
+	if n > uint64(len(r.data)) {
+		r.fail(errTruncated)
+		return
+	}
+	e.ids = make([]uint64, n)
+	e.scores = make([]uint64, n)
+	e.xs = make([]float32, n)
+	e.ys = make([]float32, n)
+	for i := range e.ids {
+		e.ids[i] = r.uvarint()
+	}
+	for i := range e.scores {
+		e.scores[i] = r.uvarint()
+	}
+	for i := range e.xs {
+		e.xs[i] = originX + float32(r.uvarint())/scale
+	}
+	for i := range e.ys {
+		e.ys[i] = originY + float32(r.uvarint())/scale
+	}
+}
+
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail(errTruncated)
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *reader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) < 1 {
+		r.fail(errTruncated)
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *reader) float32() float32 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) < 4 {
+		r.fail(errTruncated)
+		return 0
+	}
+	v := math.Float32frombits(binary.LittleEndian.Uint32(r.data))
+	r.data = r.data[4:]
+	return v
+}
+
+// ids reads a list written by appendIDs. An empty list is returned as nil.
+func (r *reader) ids() []uint64 {
+	n := r.uvarint()
+	if n == 0 || r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.data)) {
+		r.fail(errTruncated)
+		return nil
+	}
+	ids := make([]uint64, n)
+	for i := range ids {
+		ids[i] = r.uvarint()
+	}
+	return ids
+}
+
+func (r *reader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func quantize(v, origin float32) uint64 {
+	return uint64(math.Round(float64(v-origin) * scale))
+}
+
+func appendUvarint(data []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(data, buf[:n]...)
+}
+
+func appendIDs(data []byte, ids []uint64) []byte {
+	data = appendUvarint(data, uint64(len(ids)))
+	for _, id := range ids {
+		data = appendUvarint(data, id)
+	}
+	return data
+}
+
+func appendFloat32(data []byte, v float32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], math.Float32bits(v))
+	return append(data, buf[:]...)
+}
+
+func min32(a, b float32) float32 {
+	if b < a {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,104 @@
+package compact_test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/x1m3/corona/internal/codec/compact"
+	"github.com/x1m3/corona/internal/codec/msgpack"
+	"github.com/x1m3/corona/internal/messages"
+)
+
+func viewport(cookies, food int) *messages.ViewportResponse {
+	v := &messages.ViewportResponse{
+		Cookies: make([]*messages.CookieInfo, 0),
+		Food:    make([]*messages.FoodInfo, 0),
+	}
+	v.SetType(messages.ViewPortResponseType)
+	for i := 0; i < cookies; i++ {
+		v.Cookies = append(v.Cookies, &messages.CookieInfo{ID: uint64(i + 1), Score: uint64(rand.Intn(5000)), X: 500 + rand.Float32()*200, Y: 800 + rand.Float32()*150})
+	}
+	for i := 0; i < food; i++ {
+		v.Food = append(v.Food, &messages.FoodInfo{ID: rand.Uint64() << 8, Score: 1, X: 500 + rand.Float32()*200, Y: 800 + rand.Float32()*150})
+	}
+	return v
+}
+
+func TestCodec_Viewport(t *testing.T) {
+	delta := viewport(2, 5)
+	delta.Frame, delta.BaseFrame = 1000, 998
+	delta.Tick, delta.InputSeq, delta.VX, delta.VY = 123456, 42, 12.5, -3.25
+	delta.RemovedCookies = []uint64{1, 1 << 40}
+	delta.RemovedFood = []uint64{rand.Uint64()}
+
+	keyframe := viewport(20, 300)
+	keyframe.Frame, keyframe.Keyframe = 7, true
+
+	for _, v := range []*messages.ViewportResponse{viewport(0, 0), viewport(3, 0), keyframe, delta} {
+		data, err := compact.Codec.Marshal(v)
+		assert.NoError(t, err)
+
+		var header messages.Header
+		assert.NoError(t, compact.Codec.Unmarshal(data, &header))
+		assert.Equal(t, messages.ViewPortResponseType, int(header.GetType()))
+
+		decoded := &messages.ViewportResponse{}
+		assert.NoError(t, compact.Codec.Unmarshal(data, decoded))
+		assert.Equal(t, v.GetType(), decoded.GetType())
+		assert.Equal(t, v.Frame, decoded.Frame)
+		assert.Equal(t, v.Keyframe, decoded.Keyframe)
+		assert.Equal(t, v.BaseFrame, decoded.BaseFrame)
+		assert.Equal(t, v.Tick, decoded.Tick)
+		assert.Equal(t, v.InputSeq, decoded.InputSeq)
+		assert.Equal(t, v.VX, decoded.VX)
+		assert.Equal(t, v.VY, decoded.VY)
+		assert.Equal(t, v.RemovedCookies, decoded.RemovedCookies)
+		assert.Equal(t, v.RemovedFood, decoded.RemovedFood)
+		assert.Len(t, decoded.Cookies, len(v.Cookies))
+		assert.Len(t, decoded.Food, len(v.Food))
+		for i, c := range v.Cookies {
+			assert.Equal(t, c.ID, decoded.Cookies[i].ID)
+			assert.Equal(t, c.Score, decoded.Cookies[i].Score)
+			assert.InDelta(t, c.X, decoded.Cookies[i].X, 1.0/128)
+			assert.InDelta(t, c.Y, decoded.Cookies[i].Y, 1.0/128)
+		}
+		for i, f := range v.Food {
+			assert.Equal(t, f.ID, decoded.Food[i].ID)
+			assert.InDelta(t, f.X, decoded.Food[i].X, 1.0/128)
+			assert.InDelta(t, f.Y, decoded.Food[i].Y, 1.0/128)
+		}
+	}
+}
+
+func TestCodec_Size(t *testing.T) {
+	v := viewport(20, 300)
+	data, err := compact.Codec.Marshal(v)
+	assert.NoError(t, err)
+	mp, err := msgpack.Codec.Marshal(v)
+	assert.NoError(t, err)
+	assert.True(t, len(data) < len(mp)/2, "compact <%d bytes>, msgpack <%d bytes>", len(data), len(mp))
+}
+
+func TestCodec_Fallback(t *testing.T) {
+	stats := messages.NewStatsResponse(10, 20)
+	data, err := compact.Codec.Marshal(stats)
+	assert.NoError(t, err)
+
+	decoded := &messages.StatsResponse{}
+	assert.NoError(t, compact.Codec.Unmarshal(data, decoded))
+	assert.Equal(t, stats, decoded)
+}
+
+func TestCodec_Errors(t *testing.T) {
+	data, err := compact.Codec.Marshal(viewport(5, 5))
+	assert.NoError(t, err)
+
+	for i := 0; i < len(data); i++ {
+		assert.Error(t, compact.Codec.Unmarshal(data[:i], &messages.ViewportResponse{}), "truncated at %d", i)
+	}
+	assert.Error(t, compact.Codec.Unmarshal(append(data, 0), &messages.ViewportResponse{}))
+	assert.Error(t, compact.Codec.Unmarshal(data, &struct{}{}))
+	assert.Error(t, compact.Codec.Unmarshal([]byte{7}, &messages.Header{}))
+}
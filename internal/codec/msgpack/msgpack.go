@@ -23,3 +23,7 @@ func (m msgpackCodec) Unmarshal(b []byte, v interface{}) error {
 func (m msgpackCodec) Name() string {
 	return name
 }
+
+func (m msgpackCodec) Binary() bool {
+	return true
+}
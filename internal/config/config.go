@@ -0,0 +1,422 @@
+// Package config contains the settings used to run the cookies server. Values
+// are taken, from lower to higher priority, from the defaults, a JSON config
+// file, environment variables and command line flags.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/x1m3/corona/internal/logger"
+)
+
+// EnvPrefix is prepended to every setting name to build its environment variable.
+// Setting "server.port" is read from COOKIES_SERVER_PORT.
+const EnvPrefix = "COOKIES_"
+
+// secrets are settings whose value is hidden when printing the configuration.
+var secrets = map[string]struct{}{
+	"admin.token":        {},
+	"game.resume-secret": {},
+}
+
+type Server struct {
+	Host             string
+	Port             int
+	ReadTimeout      time.Duration // Maximum time to read the full http request
+	WriteTimeout     time.Duration // Maximum time to write the full http request
+	KeepAliveTimeout time.Duration // Time to close an idle connection if keep alive is enabled
+	ShutdownTimeout  time.Duration // Time given to connections and the game to finish on SIGINT/SIGTERM
+	PprofAddr        string
+	AssetsDir        string        // Frontend directory overriding the bundled one
+	MetricsPath      string        // Path serving metrics in Prometheus format. Empty disables it
+	MaxTickAge       time.Duration // /healthz fails if the simulation has not ticked for this long
+	TLSCertFile      string        // PEM certificate. TLS is enabled if set
+	TLSKeyFile       string        // PEM private key of TLSCertFile
+	TLSReloadPeriod  time.Duration // Time between checks for a renewed certificate. Zero disables it
+	RedirectPort     int           // Plain HTTP port redirecting to HTTPS. Zero disables it
+	AllowedOrigins   string        // Comma separated origins allowed to open a websocket. Empty means same host
+	MaxConnsPerIP    int           // Concurrent websockets from one address. Zero is unlimited
+	UpgradeRate      float64       // Websocket upgrades per second from one address. Zero is unlimited
+	UpgradeBurst     int           // Websocket upgrades from one address allowed at once
+	Compression      bool          // Negotiate permessage-deflate with clients that support it
+	CompressionLevel int           // Flate level, from -2 (huffman only) to 9 (best compression)
+	CompressionMin   int           // Messages smaller than this many bytes are not compressed
+	RecordDir        string        // Directory where every websocket session is recorded. Empty disables it
+}
+
+type Game struct {
+	Width              float64
+	Height             float64
+	PixelsToMeters     int
+	UpdateClientPeriod time.Duration
+	MinFPS             float64
+	MaxFPS             float64
+	Speed              int
+	TurboSpeed         int
+	MinFoodCount       uint64
+	KeyframePeriod     int           // Viewport responses between two full ones
+	DeltaThreshold     float64       // Meters an entity must move to be sent again
+	OutboxSize         int           // Messages waiting to be sent to a client
+	OutboxMaxOverflow  time.Duration // Time a client can have its outbox full before being disconnected
+	PingPeriod         time.Duration // Time between two round trip time measures
+	ResumeGrace        time.Duration // Time a dropped session is kept to be resumed
+	ResumeSecret       string        // Key to sign resume tokens. Random if empty
+	Batch              bool          // Messages queued in a simulation step are sent in a single frame
+}
+
+type Bots struct {
+	Count       int
+	SpawnPeriod time.Duration
+	Codec       string // Codec bots encode their messages with
+}
+
+type Admin struct {
+	Token string // Bearer token for the admin API. Empty disables it
+}
+
+type Log struct {
+	Level  string // debug, info, warn or error
+	Format string // text or json
+}
+
+type Config struct {
+	Server Server
+	Game   Game
+	Bots   Bots
+	Admin  Admin
+	Log    Log
+
+	// PrintOnly is set when the server was asked to print the effective
+	// configuration and exit.
+	PrintOnly bool
+}
+
+// Default returns the configuration used when nothing is overridden.
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Host:             "",
+			Port:             8000,
+			ReadTimeout:      10 * time.Second,
+			WriteTimeout:     10 * time.Second,
+			KeepAliveTimeout: 5 * time.Second,
+			ShutdownTimeout:  10 * time.Second,
+			PprofAddr:        "localhost:6060",
+			MetricsPath:      "/metrics",
+			MaxTickAge:       2 * time.Second,
+			TLSReloadPeriod:  time.Minute,
+			MaxConnsPerIP:    10,
+			UpgradeRate:      2,
+			UpgradeBurst:     10,
+			Compression:      true,
+			CompressionLevel: 1,
+			CompressionMin:   512,
+		},
+		Game: Game{
+			Width:              2000,
+			Height:             2000,
+			PixelsToMeters:     10,
+			UpdateClientPeriod: 100 * time.Millisecond,
+			MinFPS:             30,
+			MaxFPS:             45,
+			Speed:              45,
+			TurboSpeed:         70,
+			MinFoodCount:       2500,
+			KeyframePeriod:     50,
+			DeltaThreshold:     0.05,
+			OutboxSize:         256,
+			OutboxMaxOverflow:  5 * time.Second,
+			PingPeriod:         2 * time.Second,
+			ResumeGrace:        30 * time.Second,
+		},
+		Bots: Bots{
+			Count:       20,
+			SpawnPeriod: 5 * time.Second,
+			Codec:       "msgpack",
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "text",
+		},
+	}
+}
+
+// bind registers every setting as a flag of fs that writes into c.
+func (c *Config) bind(fs *flag.FlagSet) {
+	fs.StringVar(&c.Server.Host, "server.host", c.Server.Host, "virtual host to listen on")
+	fs.IntVar(&c.Server.Port, "server.port", c.Server.Port, "port to listen on")
+	fs.DurationVar(&c.Server.ReadTimeout, "server.read-timeout", c.Server.ReadTimeout, "maximum time to read a full http request")
+	fs.DurationVar(&c.Server.WriteTimeout, "server.write-timeout", c.Server.WriteTimeout, "maximum time to write a full http response")
+	fs.DurationVar(&c.Server.KeepAliveTimeout, "server.keepalive-timeout", c.Server.KeepAliveTimeout, "time to close an idle keep alive connection")
+	fs.DurationVar(&c.Server.ShutdownTimeout, "server.shutdown-timeout", c.Server.ShutdownTimeout, "time given to the server to stop gracefully")
+	fs.StringVar(&c.Server.PprofAddr, "server.pprof-addr", c.Server.PprofAddr, "address for the pprof server. Empty disables it")
+	fs.StringVar(&c.Server.MetricsPath, "server.metrics-path", c.Server.MetricsPath, "path serving metrics in Prometheus text format. Empty disables it")
+	fs.DurationVar(&c.Server.MaxTickAge, "server.max-tick-age", c.Server.MaxTickAge, "health checks fail if the simulation has not ticked for this long")
+	fs.StringVar(&c.Server.TLSCertFile, "server.tls-cert-file", c.Server.TLSCertFile, "PEM certificate file. Serves HTTPS and wss:// if set")
+	fs.StringVar(&c.Server.TLSKeyFile, "server.tls-key-file", c.Server.TLSKeyFile, "PEM private key file of the certificate")
+	fs.DurationVar(&c.Server.TLSReloadPeriod, "server.tls-reload-period", c.Server.TLSReloadPeriod, "time between checks for changes in the certificate files. 0 disables it, SIGHUP always reloads")
+	fs.IntVar(&c.Server.RedirectPort, "server.redirect-port", c.Server.RedirectPort, "plain HTTP port redirecting to HTTPS. 0 disables it")
+	fs.StringVar(&c.Server.AllowedOrigins, "server.allowed-origins", c.Server.AllowedOrigins, "comma separated origins, hosts or *.domain suffixes allowed to open a websocket. * allows any. Empty allows the same host only")
+	fs.IntVar(&c.Server.MaxConnsPerIP, "server.max-conns-per-ip", c.Server.MaxConnsPerIP, "concurrent websockets from one address. 0 is unlimited")
+	fs.Float64Var(&c.Server.UpgradeRate, "server.upgrade-rate", c.Server.UpgradeRate, "websocket upgrades per second from one address. 0 is unlimited")
+	fs.IntVar(&c.Server.UpgradeBurst, "server.upgrade-burst", c.Server.UpgradeBurst, "websocket upgrades from one address allowed at once")
+	fs.BoolVar(&c.Server.Compression, "server.compression", c.Server.Compression, "negotiate permessage-deflate compression on websockets")
+	fs.StringVar(&c.Server.RecordDir, "server.record-dir", c.Server.RecordDir, "directory to record the frames of every websocket session, to replay them with cmd/replay. Empty disables it")
+	fs.IntVar(&c.Server.CompressionLevel, "server.compression-level", c.Server.CompressionLevel, "flate compression level, from -2 (huffman only) to 9 (best compression)")
+	fs.IntVar(&c.Server.CompressionMin, "server.compression-min", c.Server.CompressionMin, "messages smaller than this many bytes are sent uncompressed")
+	fs.StringVar(&c.Server.AssetsDir, "server.assets-dir", c.Server.AssetsDir, "serve templates and static files from this directory instead of the bundled ones")
+
+	fs.Float64Var(&c.Game.Width, "game.width", c.Game.Width, "world width in meters")
+	fs.Float64Var(&c.Game.Height, "game.height", c.Game.Height, "world height in meters")
+	fs.IntVar(&c.Game.PixelsToMeters, "game.pixels-to-meters", c.Game.PixelsToMeters, "pixels per meter on the client")
+	fs.DurationVar(&c.Game.UpdateClientPeriod, "game.update-client-period", c.Game.UpdateClientPeriod, "time between viewport updates sent to a client")
+	fs.Float64Var(&c.Game.MinFPS, "game.min-fps", c.Game.MinFPS, "lowest simulation frame rate")
+	fs.Float64Var(&c.Game.MaxFPS, "game.max-fps", c.Game.MaxFPS, "highest simulation frame rate")
+	fs.IntVar(&c.Game.Speed, "game.speed", c.Game.Speed, "cookie cruise speed")
+	fs.IntVar(&c.Game.TurboSpeed, "game.turbo-speed", c.Game.TurboSpeed, "cookie speed with turbo")
+	fs.IntVar(&c.Game.KeyframePeriod, "game.keyframe-period", c.Game.KeyframePeriod, "viewport updates between two full ones. The rest only carry changes")
+	fs.Float64Var(&c.Game.DeltaThreshold, "game.delta-threshold", c.Game.DeltaThreshold, "meters an entity must move to be sent again in a viewport update")
+	fs.IntVar(&c.Game.OutboxSize, "game.outbox-size", c.Game.OutboxSize, "messages waiting to be sent to a client. New ones are dropped when it is full")
+	fs.DurationVar(&c.Game.OutboxMaxOverflow, "game.outbox-max-overflow", c.Game.OutboxMaxOverflow, "time a client can have its outbox full before being disconnected")
+	fs.DurationVar(&c.Game.PingPeriod, "game.ping-period", c.Game.PingPeriod, "time between two pings to measure the round trip time to a client")
+	fs.DurationVar(&c.Game.ResumeGrace, "game.resume-grace", c.Game.ResumeGrace, "time a player that lost the connection keeps the cookie, waiting to resume. 0 disables resuming")
+	fs.StringVar(&c.Game.ResumeSecret, "game.resume-secret", c.Game.ResumeSecret, "key to sign resume tokens. Random if empty, so they do not survive restarts")
+	fs.BoolVar(&c.Game.Batch, "game.batch", c.Game.Batch, "send the messages queued for a client in a simulation step in a single frame, if the client supports it")
+	fs.Uint64Var(&c.Game.MinFoodCount, "game.min-food-count", c.Game.MinFoodCount, "food is thrown when there is less than this")
+
+	fs.IntVar(&c.Bots.Count, "bots.count", c.Bots.Count, "number of bots playing")
+	fs.DurationVar(&c.Bots.SpawnPeriod, "bots.spawn-period", c.Bots.SpawnPeriod, "time between two bots joining")
+	fs.StringVar(&c.Bots.Codec, "bots.codec", c.Bots.Codec, "codec bots use to talk to the game: json, msgpack or compact")
+
+	fs.StringVar(&c.Admin.Token, "admin.token", c.Admin.Token, "bearer token for the admin API under /admin/. Empty disables it")
+
+	fs.StringVar(&c.Log.Level, "log.level", c.Log.Level, "lowest level logged: debug, info, warn or error")
+	fs.StringVar(&c.Log.Format, "log.format", c.Log.Format, "log output format: text or json")
+}
+
+// Load builds the configuration from the command line arguments (without the
+// program name), the environment and the config file passed with -config.
+func Load(name string, args []string, getenv func(string) string) (*Config, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := fs.String("config", getenv(EnvPrefix+"CONFIG"), "path to a JSON config file")
+	printOnly := fs.Bool("print-config", false, "print the effective configuration and exit")
+	Default().bind(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument <%s>", fs.Arg(0))
+	}
+
+	c := Default()
+	settings := flag.NewFlagSet(name, flag.ContinueOnError)
+	settings.SetOutput(ioutil.Discard)
+	c.bind(settings)
+
+	if *path != "" {
+		if err := loadFile(settings, *path); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	settings.VisitAll(func(f *flag.Flag) {
+		env := envName(f.Name)
+		if v := getenv(env); v != "" && err == nil {
+			if errSet := f.Value.Set(v); errSet != nil {
+				err = fmt.Errorf("invalid value <%s> for %s: %v", v, env, errSet)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		if s := settings.Lookup(f.Name); s != nil && err == nil {
+			err = s.Value.Set(f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.PrintOnly = *printOnly
+	return c, c.Validate()
+}
+
+// loadFile reads a JSON document like {"server": {"port": 8080}}. Nested keys
+// are joined with dots and parsed exactly as the flag with the same name.
+func loadFile(settings *flag.FlagSet, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %v", err)
+	}
+
+	doc := make(map[string]interface{})
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return fmt.Errorf("parsing config file <%s>: %v", path, err)
+	}
+
+	var walk func(prefix string, m map[string]interface{}) error
+	walk = func(prefix string, m map[string]interface{}) error {
+		for k, v := range m {
+			key := prefix + k
+			if sub, ok := v.(map[string]interface{}); ok {
+				if err := walk(key+".", sub); err != nil {
+					return err
+				}
+				continue
+			}
+			if settings.Lookup(key) == nil {
+				return fmt.Errorf("config file <%s>: unknown setting <%s>", path, key)
+			}
+			if err := settings.Set(key, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("config file <%s>: invalid value for <%s>: %v", path, key, err)
+			}
+		}
+		return nil
+	}
+	return walk("", doc)
+}
+
+// Validate checks that the settings can be used to start a game.
+func (c *Config) Validate() error {
+	switch {
+	case c.Server.Port <= 0 || c.Server.Port > 65535:
+		return fmt.Errorf("server.port must be between 1 and 65535, got %d", c.Server.Port)
+	case c.Server.ReadTimeout < 0, c.Server.WriteTimeout < 0, c.Server.KeepAliveTimeout < 0, c.Server.ShutdownTimeout < 0:
+		return fmt.Errorf("server timeouts cannot be negative")
+	case c.Server.MaxTickAge <= 0:
+		return fmt.Errorf("server.max-tick-age must be positive")
+	case (c.Server.TLSCertFile == "") != (c.Server.TLSKeyFile == ""):
+		return fmt.Errorf("server.tls-cert-file and server.tls-key-file must be set together")
+	case c.Server.TLSReloadPeriod < 0:
+		return fmt.Errorf("server.tls-reload-period cannot be negative")
+	case c.Server.RedirectPort < 0 || c.Server.RedirectPort > 65535:
+		return fmt.Errorf("server.redirect-port must be between 0 and 65535, got %d", c.Server.RedirectPort)
+	case c.Server.RedirectPort != 0 && !c.TLS():
+		return fmt.Errorf("server.redirect-port needs TLS to be enabled")
+	case c.Server.RedirectPort == c.Server.Port:
+		return fmt.Errorf("server.redirect-port cannot be the same as server.port")
+	case c.Server.MaxConnsPerIP < 0:
+		return fmt.Errorf("server.max-conns-per-ip cannot be negative")
+	case c.Server.UpgradeRate < 0:
+		return fmt.Errorf("server.upgrade-rate cannot be negative")
+	case c.Server.UpgradeBurst < 1:
+		return fmt.Errorf("server.upgrade-burst must be at least 1")
+	case c.Server.CompressionLevel < -2 || c.Server.CompressionLevel > 9:
+		return fmt.Errorf("server.compression-level must be between -2 and 9, got %d", c.Server.CompressionLevel)
+	case c.Server.CompressionMin < 0:
+		return fmt.Errorf("server.compression-min cannot be negative")
+	case c.Game.Width <= 300 || c.Game.Height <= 300:
+		return fmt.Errorf("game.width and game.height must be greater than 300 meters")
+	case c.Game.PixelsToMeters <= 0:
+		return fmt.Errorf("game.pixels-to-meters must be positive")
+	case c.Game.UpdateClientPeriod <= 0:
+		return fmt.Errorf("game.update-client-period must be positive")
+	case c.Game.MinFPS < 1:
+		return fmt.Errorf("game.min-fps must be at least 1")
+	case c.Game.MaxFPS < c.Game.MinFPS:
+		return fmt.Errorf("game.max-fps (%v) cannot be lower than game.min-fps (%v)", c.Game.MaxFPS, c.Game.MinFPS)
+	case c.Game.Speed <= 0:
+		return fmt.Errorf("game.speed must be positive")
+	case c.Game.TurboSpeed < c.Game.Speed:
+		return fmt.Errorf("game.turbo-speed cannot be lower than game.speed")
+	case c.Game.KeyframePeriod < 1:
+		return fmt.Errorf("game.keyframe-period must be at least 1")
+	case c.Game.DeltaThreshold < 0:
+		return fmt.Errorf("game.delta-threshold cannot be negative")
+	case c.Game.OutboxSize < 1:
+		return fmt.Errorf("game.outbox-size must be at least 1")
+	case c.Game.OutboxMaxOverflow <= 0:
+		return fmt.Errorf("game.outbox-max-overflow must be positive")
+	case c.Game.PingPeriod <= 0:
+		return fmt.Errorf("game.ping-period must be positive")
+	case c.Game.ResumeGrace < 0:
+		return fmt.Errorf("game.resume-grace cannot be negative")
+	case c.Bots.Count < 0:
+		return fmt.Errorf("bots.count cannot be negative")
+	case c.Bots.SpawnPeriod <= 0:
+		return fmt.Errorf("bots.spawn-period must be positive")
+	case c.Bots.Codec == "":
+		return fmt.Errorf("bots.codec cannot be empty")
+	}
+	if _, err := logger.ParseLevel(c.Log.Level); err != nil {
+		return fmt.Errorf("log.level: %v", err)
+	}
+	if _, err := logger.ParseFormat(c.Log.Format); err != nil {
+		return fmt.Errorf("log.format: %v", err)
+	}
+	return nil
+}
+
+// TLS returns true if the server must use TLS.
+func (c *Config) TLS() bool {
+	return c.Server.TLSCertFile != ""
+}
+
+// AllowedOrigins returns the list in Server.AllowedOrigins.
+func (c *Config) AllowedOrigins() []string {
+	origins := make([]string, 0)
+	for _, origin := range strings.Split(c.Server.AllowedOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// Logger returns a logger writing to w with the configured level and format.
+func (c *Config) Logger(w io.Writer) *logger.Logger {
+	level, _ := logger.ParseLevel(c.Log.Level)
+	format, _ := logger.ParseFormat(c.Log.Format)
+	return logger.New(w, level, format)
+}
+
+// WriteTo writes the effective configuration, one "name = value" per line.
+func (c *Config) WriteTo(w io.Writer) (int64, error) {
+	settings := flag.NewFlagSet("", flag.ContinueOnError)
+	c.bind(settings)
+
+	lines := make([]string, 0)
+	settings.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if _, secret := secrets[f.Name]; secret && value != "" {
+			value = "********"
+		}
+		lines = append(lines, fmt.Sprintf("%s = %s\n", f.Name, value))
+	})
+	sort.Strings(lines)
+
+	var n int64
+	for _, l := range lines {
+		written, err := io.WriteString(w, l)
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (c *Config) String() string {
+	var b strings.Builder
+	_, _ = c.WriteTo(&b)
+	return b.String()
+}
+
+func envName(setting string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(setting))
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func env(vars map[string]string) func(string) string {
+	return func(k string) string {
+		return vars[k]
+	}
+}
+
+func TestLoad_Defaults(t *testing.T) {
+	c, err := Load("cookies", nil, env(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, Default(), c)
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cookies.json")
+	doc := `{"server": {"port": 9000, "host": "file"}, "game": {"min-food-count": 1000000, "update-client-period": "50ms"}}`
+	assert.NoError(t, ioutil.WriteFile(path, []byte(doc), 0600))
+
+	c, err := Load(
+		"cookies",
+		[]string{"-config", path, "-server.port", "9002"},
+		env(map[string]string{"COOKIES_SERVER_PORT": "9001", "COOKIES_SERVER_HOST": "env"}),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 9002, c.Server.Port)
+	assert.Equal(t, "env", c.Server.Host)
+	assert.Equal(t, uint64(1000000), c.Game.MinFoodCount)
+	assert.Equal(t, 50*time.Millisecond, c.Game.UpdateClientPeriod)
+}
+
+func TestLoad_Errors(t *testing.T) {
+	_, err := Load("cookies", []string{"-game.max-fps", "10"}, env(nil))
+	assert.Error(t, err)
+
+	_, err = Load("cookies", nil, env(map[string]string{"COOKIES_GAME_SPEED": "fast"}))
+	assert.Error(t, err)
+
+	_, err = Load("cookies", []string{"-log.level", "verbose"}, env(nil))
+	assert.Error(t, err)
+
+	_, err = Load("cookies", []string{"-server.tls-cert-file", "cert.pem"}, env(nil))
+	assert.Error(t, err)
+
+	_, err = Load("cookies", []string{"-server.redirect-port", "80"}, env(nil))
+	assert.Error(t, err)
+
+	dir, err := ioutil.TempDir("", "config")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cookies.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{"server": {"unknown": 1}}`), 0600))
+	_, err = Load("cookies", []string{"-config", path}, env(nil))
+	assert.Error(t, err)
+}
+
+func TestConfig_AllowedOrigins(t *testing.T) {
+	c := Default()
+	assert.Empty(t, c.AllowedOrigins())
+
+	c.Server.AllowedOrigins = "https://cookies.io, *.example.com,,"
+	assert.Equal(t, []string{"https://cookies.io", "*.example.com"}, c.AllowedOrigins())
+}
+
+func TestConfig_String(t *testing.T) {
+	c := Default()
+	c.Server.Port = 1234
+	assert.Contains(t, c.String(), "server.port = 1234\n")
+}
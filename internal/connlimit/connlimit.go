@@ -0,0 +1,202 @@
+// Package connlimit decides which websocket upgrades are accepted, using an
+// origin allowlist and per IP limits of concurrent connections and upgrades
+// per second.
+package connlimit
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/x1m3/corona/internal/metrics"
+)
+
+var (
+	ErrOrigin             = errors.New("origin not allowed")
+	ErrTooManyConnections = errors.New("too many connections from the same address")
+	ErrRateLimited        = errors.New("too many connection attempts from the same address")
+)
+
+var metricRejected = metrics.NewCounterVec(
+	"cookies_ws_rejected_total",
+	"Websocket upgrades rejected, by reason.",
+	"reason")
+
+func init() {
+	metrics.Default.Register(metricRejected)
+}
+
+// reasons are the metric labels of each error.
+var reasons = map[error]string{
+	ErrOrigin:             "origin",
+	ErrTooManyConnections: "conns_per_ip",
+	ErrRateLimited:        "rate",
+}
+
+// pruneEvery is the number of admitted connections between two removals of
+// idle addresses.
+const pruneEvery = 1024
+
+type Config struct {
+	// AllowedOrigins are origins (https://cookies.io), hosts (cookies.io) or
+	// host suffixes (*.cookies.io) allowed to connect. "*" allows any origin.
+	// If empty, only pages served by the same host are allowed.
+	AllowedOrigins []string
+	MaxConnsPerIP  int     // Zero means unlimited
+	UpgradeRate    float64 // Upgrades per second per IP. Zero means unlimited
+	UpgradeBurst   int     // Upgrades allowed at once before UpgradeRate applies
+}
+
+type Limiter struct {
+	cfg Config
+	now func() time.Time
+
+	sync.Mutex
+	clients  map[string]*client
+	admitted int
+}
+
+// client is the state of an IP address. tokens is a token bucket refilled at
+// UpgradeRate per second up to UpgradeBurst.
+type client struct {
+	conns  int
+	tokens float64
+	last   time.Time
+}
+
+func New(cfg Config) *Limiter {
+	if cfg.UpgradeBurst < 1 {
+		cfg.UpgradeBurst = 1
+	}
+	return &Limiter{cfg: cfg, now: time.Now, clients: make(map[string]*client)}
+}
+
+// Admit checks if the upgrade request can be accepted. If so, release must be
+// called once the connection is closed.
+func (l *Limiter) Admit(req *http.Request) (release func(), err error) {
+	if !l.originAllowed(req) {
+		return nil, reject(ErrOrigin)
+	}
+
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	c, found := l.clients[ip]
+	if !found {
+		c = &client{tokens: float64(l.cfg.UpgradeBurst), last: l.now()}
+		l.clients[ip] = c
+	}
+
+	if l.cfg.UpgradeRate > 0 {
+		l.refill(c)
+		if c.tokens < 1 {
+			return nil, reject(ErrRateLimited)
+		}
+	}
+	if l.cfg.MaxConnsPerIP > 0 && c.conns >= l.cfg.MaxConnsPerIP {
+		return nil, reject(ErrTooManyConnections)
+	}
+	if l.cfg.UpgradeRate > 0 {
+		c.tokens--
+	}
+	c.conns++
+
+	l.admitted++
+	if l.admitted%pruneEvery == 0 {
+		l.prune()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.Lock()
+			c.conns--
+			l.Unlock()
+		})
+	}, nil
+}
+
+// Conns returns the number of open connections from ip.
+func (l *Limiter) Conns(ip string) int {
+	l.Lock()
+	defer l.Unlock()
+	if c, found := l.clients[ip]; found {
+		return c.conns
+	}
+	return 0
+}
+
+func (l *Limiter) refill(c *client) {
+	now := l.now()
+	c.tokens += now.Sub(c.last).Seconds() * l.cfg.UpgradeRate
+	if max := float64(l.cfg.UpgradeBurst); c.tokens > max {
+		c.tokens = max
+	}
+	c.last = now
+}
+
+// prune forgets the addresses without connections and with a full bucket, as
+// they are in the same state as a new address.
+func (l *Limiter) prune() {
+	for ip, c := range l.clients {
+		if c.conns > 0 {
+			continue
+		}
+		if l.cfg.UpgradeRate > 0 {
+			l.refill(c)
+			if c.tokens < float64(l.cfg.UpgradeBurst) {
+				continue
+			}
+		}
+		delete(l.clients, ip)
+	}
+}
+
+func (l *Limiter) originAllowed(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		// Not a browser, so the origin cannot be trusted anyway.
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	if len(l.cfg.AllowedOrigins) == 0 {
+		return strings.EqualFold(u.Host, req.Host)
+	}
+	for _, allowed := range l.cfg.AllowedOrigins {
+		switch {
+		case allowed == "*":
+			return true
+		case strings.HasPrefix(allowed, "*."):
+			if strings.HasSuffix(strings.ToLower(u.Hostname()), strings.ToLower(allowed[1:])) {
+				return true
+			}
+		case strings.Contains(allowed, "://"):
+			if strings.EqualFold(allowed, u.Scheme+"://"+u.Host) {
+				return true
+			}
+		default:
+			if strings.EqualFold(allowed, u.Host) || strings.EqualFold(allowed, u.Hostname()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func reject(err error) error {
+	metricRejected.With(reasons[err]).Inc()
+	return err
+}
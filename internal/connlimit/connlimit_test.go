@@ -0,0 +1,90 @@
+package connlimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func request(ip, origin string) *http.Request {
+	req := httptest.NewRequest("GET", "http://cookies.io/ws/", nil)
+	req.RemoteAddr = ip + ":1234"
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	return req
+}
+
+func TestLimiter_Origins(t *testing.T) {
+	sameHost := New(Config{})
+	allowlist := New(Config{AllowedOrigins: []string{"https://play.cookies.io", "*.example.com", "localhost:8000"}})
+
+	tests := []struct {
+		limiter *Limiter
+		origin  string
+		allowed bool
+	}{
+		{limiter: sameHost, origin: "", allowed: true},
+		{limiter: sameHost, origin: "http://cookies.io", allowed: true},
+		{limiter: sameHost, origin: "http://evil.io", allowed: false},
+		{limiter: allowlist, origin: "https://play.cookies.io", allowed: true},
+		{limiter: allowlist, origin: "http://play.cookies.io", allowed: false},
+		{limiter: allowlist, origin: "https://games.example.com", allowed: true},
+		{limiter: allowlist, origin: "https://example.com.evil.io", allowed: false},
+		{limiter: allowlist, origin: "http://localhost:8000", allowed: true},
+		{limiter: allowlist, origin: "http://cookies.io", allowed: false},
+		{limiter: New(Config{AllowedOrigins: []string{"*"}}), origin: "http://evil.io", allowed: true},
+	}
+	for _, test := range tests {
+		release, err := test.limiter.Admit(request("10.0.0.1", test.origin))
+		if test.allowed {
+			assert.NoError(t, err, test.origin)
+			release()
+		} else {
+			assert.Equal(t, ErrOrigin, err, test.origin)
+		}
+	}
+}
+
+func TestLimiter_ConnsPerIP(t *testing.T) {
+	l := New(Config{MaxConnsPerIP: 2})
+
+	release1, err := l.Admit(request("10.0.0.1", ""))
+	assert.NoError(t, err)
+	_, err = l.Admit(request("10.0.0.1", ""))
+	assert.NoError(t, err)
+	_, err = l.Admit(request("10.0.0.1", ""))
+	assert.Equal(t, ErrTooManyConnections, err)
+
+	_, err = l.Admit(request("10.0.0.2", ""))
+	assert.NoError(t, err)
+
+	release1()
+	release1()
+	assert.Equal(t, 1, l.Conns("10.0.0.1"))
+	_, err = l.Admit(request("10.0.0.1", ""))
+	assert.NoError(t, err)
+}
+
+func TestLimiter_UpgradeRate(t *testing.T) {
+	now := time.Now()
+	l := New(Config{UpgradeRate: 2, UpgradeBurst: 3})
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		release, err := l.Admit(request("10.0.0.1", ""))
+		assert.NoError(t, err)
+		release()
+	}
+	_, err := l.Admit(request("10.0.0.1", ""))
+	assert.Equal(t, ErrRateLimited, err)
+
+	now = now.Add(500 * time.Millisecond)
+	_, err = l.Admit(request("10.0.0.1", ""))
+	assert.NoError(t, err)
+	_, err = l.Admit(request("10.0.0.1", ""))
+	assert.Equal(t, ErrRateLimited, err)
+}
@@ -9,10 +9,11 @@ import (
 type contactListener struct {
 	chColl2Cookies   chan *collision2CookiesDTO
 	chCollCookieFood chan *collissionCookieFoodDTO
+	done             <-chan struct{}
 }
 
-func newContactListener(chCkCk chan *collision2CookiesDTO, chCkFd chan *collissionCookieFoodDTO) *contactListener {
-	return &contactListener{chColl2Cookies: chCkCk, chCollCookieFood: chCkFd}
+func newContactListener(chCkCk chan *collision2CookiesDTO, chCkFd chan *collissionCookieFoodDTO, done <-chan struct{}) *contactListener {
+	return &contactListener{chColl2Cookies: chCkCk, chCollCookieFood: chCkFd, done: done}
 }
 
 func (l *contactListener) BeginContact(contact box2d.B2ContactInterface) {
@@ -61,11 +62,17 @@ func (l *contactListener) PostSolve(contact box2d.B2ContactInterface, impulse *b
 }
 
 func (l *contactListener) contactBetweenCookies(cookie1 *Cookie, cookie2 *Cookie) {
-	l.chColl2Cookies <- &collision2CookiesDTO{cookie1: cookie1, cookie2: cookie2}
+	select {
+	case l.chColl2Cookies <- &collision2CookiesDTO{cookie1: cookie1, cookie2: cookie2}:
+	case <-l.done:
+	}
 }
 
 func (l *contactListener) contactBetweenCookiesAndFood(cookie *Cookie, food *Food) {
 	if time.Since(food.createdOn) > 1000*time.Millisecond {
-		l.chCollCookieFood <- &collissionCookieFoodDTO{cookie: cookie, food: food}
+		select {
+		case l.chCollCookieFood <- &collissionCookieFoodDTO{cookie: cookie, food: food}:
+		case <-l.done:
+		}
 	}
 }
@@ -0,0 +1,42 @@
+package corona
+
+import (
+	"errors"
+
+	"github.com/x1m3/corona/internal/corona/sessionmanager"
+	"github.com/x1m3/corona/internal/messages"
+)
+
+// Errors returned by the game for requests that are not valid in the state of
+// the session. They are sent to clients with an error code.
+var (
+	ErrUnknownMessage  = messages.ErrNoHandler
+	ErrSessionNotFound = sessionmanager.ErrSessionNotFound
+	ErrAlreadyLogged   = sessionmanager.ErrAlreadyLogged
+	ErrNotLogged       = sessionmanager.ErrNotLogged
+	ErrNotPlaying      = sessionmanager.ErrNotPlaying
+)
+
+// errorCodes are the codes sent to clients for the errors of the game. Other
+// errors are internal, and their details are not sent.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrUnknownMessage, messages.ErrorCodeUnknownMessage},
+	{ErrSessionNotFound, messages.ErrorCodeSessionNotFound},
+	{ErrAlreadyLogged, messages.ErrorCodeAlreadyLogged},
+	{ErrNotLogged, messages.ErrorCodeNotLogged},
+	{ErrNotPlaying, messages.ErrorCodeNotPlaying},
+}
+
+// errorResponse returns the response telling the client that a request of
+// type req failed with err.
+func errorResponse(req messages.Message, err error) *messages.ErrorResponse {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return messages.NewErrorResponse(c.code, err.Error(), req.GetType())
+		}
+	}
+	return messages.NewErrorResponse(messages.ErrorCodeInternal, "internal error", req.GetType())
+}
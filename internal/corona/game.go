@@ -1,87 +1,318 @@
 package corona
 
 import (
-	"errors"
+	"context"
 	"fmt"
-	"log"
 	"math/rand"
 	"time"
 
-	"github.com/ByteArena/box2d"
-
 	"github.com/x1m3/corona/internal/corona/sessionmanager"
+	"github.com/x1m3/corona/internal/logger"
 	"github.com/x1m3/corona/internal/messages"
 )
 
 type Game struct {
-	gSessions *sessionmanager.Sessions
-	world     *world
-	width     float64
-	height    float64
+	log         *logger.Logger
+	gSessions   *sessionmanager.Sessions
+	world       *world
+	dispatcher  *messages.Dispatcher
+	resume      *resumeTokens
+	resumeGrace time.Duration
+	graceTimers *graceTimers
+	batch       bool
+	width       float64
+	height      float64
+}
+
+// Config holds the parameters of a game.
+type Config struct {
+	Width              float64
+	Height             float64
+	UpdateClientPeriod time.Duration
+	MinFPS             float64
+	MaxFPS             float64
+	Speed              int
+	TurboSpeed         int
+	MinFoodCount       uint64
+	KeyframePeriod     int            // Viewport responses between two full ones
+	DeltaThreshold     float64        // Meters an entity must move to be sent again in a delta
+	OutboxSize         int            // Messages waiting to be sent to a client before dropping new ones
+	OutboxMaxOverflow  time.Duration  // Time an outbox can be full before its session is closed
+	PingPeriod         time.Duration  // Time between two round trip time measures of a client
+	ResumeGrace        time.Duration  // Time a dropped session is kept to be resumed. Zero closes it at once
+	ResumeSecret       []byte         // Key to sign resume tokens. Random if empty
+	Batch              bool           // Messages queued for a client in a simulation step are sent in a single frame
+	Logger             *logger.Logger // logger.Default() if nil
+}
+
+// DefaultConfig returns the parameters of a standard 2000x2000 meters game.
+func DefaultConfig() Config {
+	return Config{
+		Width:              2000,
+		Height:             2000,
+		UpdateClientPeriod: 100 * time.Millisecond,
+		MinFPS:             30,
+		MaxFPS:             45,
+		Speed:              45,
+		TurboSpeed:         70,
+		MinFoodCount:       2500,
+		KeyframePeriod:     50,
+		DeltaThreshold:     0.05,
+		OutboxSize:         256,
+		OutboxMaxOverflow:  5 * time.Second,
+		PingPeriod:         2 * time.Second,
+		ResumeGrace:        30 * time.Second,
+	}
 }
 
 // New returns a new cookies game.
-func New(widthX, widthY float64, updateClientPeriod time.Duration) *Game {
+func New(cfg Config) *Game {
+	log := cfg.Logger
+	if log == nil {
+		log = logger.Default()
+	}
 
-	gameSessions := sessionmanager.New()
+	gameSessions := sessionmanager.New(log.With("component", "sessions"), cfg.OutboxSize, cfg.OutboxMaxOverflow)
 
-	return &Game{
-		gSessions: gameSessions,
-		world:     NewWorld(gameSessions, widthX, widthY, 30, 45, 45, 70, 2500, updateClientPeriod),
-		width:     widthX,
-		height:    widthY,
+	g := &Game{
+		log:         log,
+		gSessions:   gameSessions,
+		world:       NewWorld(gameSessions, log.With("component", "world"), cfg),
+		dispatcher:  messages.NewDispatcher(),
+		resume:      newResumeTokens(cfg.ResumeSecret),
+		resumeGrace: cfg.ResumeGrace,
+		graceTimers: newGraceTimers(),
+		batch:       cfg.Batch,
+		width:       cfg.Width,
+		height:      cfg.Height,
 	}
+
+	g.dispatcher.Handle(messages.ViewPortRequestType, func(sessionID uint64, msg messages.Message) (messages.Message, error) {
+		g.UpdateViewPortRequest(sessionID, msg.(*messages.ViewPortRequest))
+		return nil, nil
+	})
+	g.dispatcher.Handle(messages.UserJoinRequestType, func(sessionID uint64, msg messages.Message) (messages.Message, error) {
+		resp, err := g.UserJoin(sessionID, msg.(*messages.UserJoinRequest))
+		if err != nil {
+			return nil, err
+		}
+		return resp, nil
+	})
+	g.dispatcher.Handle(messages.CreateCookieRequestType, func(sessionID uint64, msg messages.Message) (messages.Message, error) {
+		resp, err := g.CreateCookie(sessionID, msg.(*messages.CreateCookieRequest))
+		if err != nil {
+			return nil, err
+		}
+		return resp, nil
+	})
+	g.dispatcher.Handle(messages.PongType, func(sessionID uint64, msg messages.Message) (messages.Message, error) {
+		err := g.Pong(sessionID, msg.(*messages.Pong))
+		if err == sessionmanager.ErrUnexpectedPong {
+			// Answers to outdated pings are not an error of the client.
+			g.log.Debug("Discarded outdated pong", "session", sessionID)
+			return nil, nil
+		}
+		return nil, err
+	})
+	return g
+}
+
+// Dispatcher returns the handlers of the messages sent by clients.
+func (g *Game) Dispatcher() *messages.Dispatcher {
+	return g.dispatcher
+}
+
+// Logger returns the logger used by the game.
+func (g *Game) Logger() *logger.Logger {
+	return g.log
 }
 
 func (g *Game) Init() {
 	g.world.createWorld()
-	go g.world.runSimulation(4, 1)
+	g.world.run(4, 1)
+}
+
+// Shutdown stops the simulation and the resume grace periods, and closes all
+// sessions, closing their outboxes.
+// Responses already queued can still be read, so connections can be drained.
+// If the world goroutines do not finish before ctx is done, ctx.Err() is returned.
+func (g *Game) Shutdown(ctx context.Context) error {
+	g.graceTimers.stop()
+	g.world.stop()
+
+	stopped := make(chan struct{})
+	go func() {
+		g.world.wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	g.gSessions.Each(func(sessionID uint64) bool {
+		if err := g.gSessions.Close(sessionID); err != nil {
+			g.log.Error("Error closing session on shutdown", "session", sessionID, "err", err)
+		}
+		return true
+	})
+	return nil
 }
 
-func (g *Game) NewSession() (uint64, chan interface{}, chan interface{}) {
+// NewSession creates a session. The messages for its client are queued in the
+// returned outbox, that is closed when the session ends.
+func (g *Game) NewSession() (uint64, *sessionmanager.Outbox) {
 	id := g.gSessions.Add()
-	respCh, _ := g.gSessions.GetResponseChannel(id)
-	eogCh, _ := g.gSessions.GetEndOfGameChannel(id)
-	return id, respCh, eogCh
+	outbox, _ := g.gSessions.GetOutbox(id)
+	return id, outbox
+}
+
+// SessionInfo is a snapshot of a session with the position of its cookie, if playing.
+type SessionInfo struct {
+	sessionmanager.SessionInfo
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// Session returns a snapshot of a session.
+func (g *Game) Session(sessionID uint64) (*SessionInfo, error) {
+	info, err := g.gSessions.Info(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	body, err := g.gSessions.GetCookieBody(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SessionInfo{SessionInfo: *info}
+	if body != nil {
+		g.world.worldMutex.RLock()
+		s.X, s.Y = body.GetPosition().X, body.GetPosition().Y
+		g.world.worldMutex.RUnlock()
+	}
+	return s, nil
+}
+
+// Sessions returns a snapshot of all sessions.
+func (g *Game) Sessions() []*SessionInfo {
+	sessions := make([]*SessionInfo, 0)
+	g.gSessions.Each(func(sessionID uint64) bool {
+		if s, err := g.Session(sessionID); err == nil {
+			sessions = append(sessions, s)
+		}
+		return true
+	})
+	return sessions
 }
 
+// SetScore changes the score of a session. The cookie size is updated on the next simulation steps.
+func (g *Game) SetScore(sessionID uint64, score uint64) error {
+	return g.gSessions.SetScore(sessionID, score)
+}
+
+// SpawnFood throws count pieces of food around the point (x,y).
+func (g *Game) SpawnFood(count int, x, y float64) error {
+	if count <= 0 {
+		return fmt.Errorf("invalid food count <%d>", count)
+	}
+	if x < 0 || x > g.width || y < 0 || y > g.height {
+		return fmt.Errorf("position <%f,%f> is out of the world", x, y)
+	}
+	g.world.throwFood(throwFoodTask{count: count, x: x, y: y})
+	return nil
+}
+
+// MinFoodCount returns the amount of food below which new food is thrown.
+func (g *Game) MinFoodCount() uint64 {
+	return g.world.getMinFoodCount()
+}
+
+func (g *Game) SetMinFoodCount(n uint64) {
+	g.world.setMinFoodCount(n)
+}
+
+// SetSessionRemoteAddr records the network address of the client connected to a session.
+func (g *Game) SetSessionRemoteAddr(sessionID uint64, addr string) error {
+	return g.gSessions.SetRemoteAddr(sessionID, addr)
+}
+
+// SetSessionTraffic sets where the bytes sent to the client of a session are counted.
+func (g *Game) SetSessionTraffic(sessionID uint64, counter sessionmanager.TrafficCounter) error {
+	return g.gSessions.SetTrafficCounter(sessionID, counter)
+}
+
+// SetSessionCodec records the codec used by the client connected to a session.
+func (g *Game) SetSessionCodec(sessionID uint64, codecName string) error {
+	return g.gSessions.SetCodec(sessionID, codecName)
+}
+
+// UserJoin joins a user, if its client speaks a supported protocol version.
+// Otherwise, the response tells why it was rejected.
 func (g *Game) UserJoin(sessionID uint64, req *messages.UserJoinRequest) (*messages.UserJoinResponse, error) {
+	version, capabilities, err := messages.Negotiate(req.Version, req.Capabilities)
+	if err != nil {
+		g.log.Info("Rejected client with unsupported protocol", "session", sessionID, "version", req.Version)
+		metricProtocolRejections.Inc()
+		resp := messages.NewUserJoinResponse(false, nil)
+		resp.Data.Reason = err.Error()
+		return resp, nil
+	}
 
-	if err := g.gSessions.Login(sessionID, req.Username); err != nil {
+	if err := g.gSessions.Login(sessionID, req.Username, capabilities); err != nil {
 		return nil, err
 	}
 
-	return messages.NewUserJoinResponse(true, nil), nil
+	resp := messages.NewUserJoinResponse(true, nil)
+	resp.Data.Version = version
+	resp.Data.Capabilities = capabilities
+	for _, c := range capabilities {
+		switch c {
+		case messages.CapabilityResume:
+			resp.Data.ResumeToken, _ = g.issueResumeToken(sessionID)
+		case messages.CapabilityBatch:
+			if outbox, err := g.gSessions.GetOutbox(sessionID); err == nil {
+				outbox.SetBatched(g.batch)
+			}
+		}
+	}
+	return resp, nil
 }
 
 func (g *Game) Logout(sessionID uint64) {
-	var body *box2d.B2Body
-	var err error
+	if err := g.Kick(sessionID); err != nil {
+		g.log.Error("Error on logout", "session", sessionID, "err", err)
+	}
+}
 
-	if body, err = g.gSessions.GetCookieBody(sessionID); err != nil {
-		log.Printf("Error on Logout. <%s>", err)
-		return
+// Kick removes the cookie of a session from the world and closes the session.
+// The client connection is closed once the pending responses are sent.
+func (g *Game) Kick(sessionID uint64) error {
+	body, err := g.gSessions.GetCookieBody(sessionID)
+	if err != nil {
+		return err
 	}
 
 	if body != nil {
 		g.world.removeCookie(body)
 	}
-	if err := g.gSessions.Close(sessionID); err != nil {
-		log.Printf("Error on Logout. <%s>", err)
-		return
-	}
+	err = g.gSessions.Close(sessionID)
+	g.world.views.remove(sessionID)
+	return err
 }
 
 func (g *Game) CreateCookie(sessionID uint64, req *messages.CreateCookieRequest) (*messages.CreateCookieResponse, error) {
 
 	isLogged, err := g.gSessions.IsLogged(sessionID)
 	if err != nil {
-		log.Printf("Error with inconsistent session state. <%s>", err)
+		g.log.Error("Inconsistent session state", "session", sessionID, "err", err)
 		return nil, err
 	}
 
 	if !isLogged {
-		return nil, errors.New("not logged user wants to play")
+		return nil, ErrNotLogged
 	}
 
 	x := float64(300 + rand.Intn(int(g.width-300)))
@@ -89,13 +320,13 @@ func (g *Game) CreateCookie(sessionID uint64, req *messages.CreateCookieRequest)
 
 	score, err := g.gSessions.GetScore(sessionID)
 	if err != nil {
-		log.Printf("Error getting session score. <%s>", err)
+		g.log.Error("Error getting session score", "session", sessionID, "err", err)
 		return nil, err
 	}
 
 	err = g.gSessions.SetCookieBody(sessionID, g.world.addCookieToWorld(x, y, sessionID, score))
 	if err != nil {
-		log.Printf("Error adding cookie to session, <%s>", err)
+		g.log.Error("Error adding cookie to session", "session", sessionID, "err", err)
 	}
 
 	if err := g.gSessions.StartPlaying(sessionID); err != nil {
@@ -104,9 +335,27 @@ func (g *Game) CreateCookie(sessionID uint64, req *messages.CreateCookieRequest)
 	return messages.NewCreateCookieResponse(sessionID, score, float32(x), float32(y)), nil
 }
 
+// Pong records the answer of a client to a ping.
+func (g *Game) Pong(sessionID uint64, req *messages.Pong) error {
+	rtt, err := g.gSessions.Pong(sessionID, req.ID)
+	if err != nil {
+		return err
+	}
+	metricRTT.Observe(rtt.Seconds())
+	return nil
+}
+
 func (g *Game) UpdateViewPortRequest(sessionID uint64, req *messages.ViewPortRequest) {
-	err := g.gSessions.SetViewportRequest(sessionID, req.X, req.Y, req.XX, req.YY, req.Angle, req.Turbo)
+	err := g.gSessions.SetViewportRequest(sessionID, req.X, req.Y, req.XX, req.YY, req.Angle, req.Turbo, req.Seq)
 	if err != nil {
-		fmt.Printf("Error updating viewport <%s>", err)
+		g.log.Warn("Error updating viewport", "session", sessionID, "err", err)
+		return
+	}
+	if req.AckFrame == 0 && !req.Resync {
+		return
+	}
+	// Clients without deltas always get keyframes, as they never acknowledge one.
+	if delta, _ := g.gSessions.HasCapability(sessionID, messages.CapabilityDelta); delta {
+		g.world.views.get(sessionID).ack(req.AckFrame, req.Resync)
 	}
 }
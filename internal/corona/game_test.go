@@ -0,0 +1,237 @@
+package corona_test
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/x1m3/corona/internal/codec/msgpack"
+	"github.com/x1m3/corona/internal/corona"
+	"github.com/x1m3/corona/internal/corona/sessionmanager"
+	"github.com/x1m3/corona/internal/logger"
+	"github.com/x1m3/corona/internal/messages"
+)
+
+func TestGame_Shutdown(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		cfg := corona.DefaultConfig()
+		cfg.Width, cfg.Height = 1000, 1000
+		game := corona.New(cfg)
+		game.Init()
+
+		sessionID, outbox := game.NewSession()
+		_, err := game.UserJoin(sessionID, messages.NewUserJoinRequest("manolo"))
+		assert.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		assert.NoError(t, game.Shutdown(ctx))
+		cancel()
+
+		_, err = outbox.Take()
+		assert.Equal(t, sessionmanager.ErrOutboxClosed, err)
+	}
+
+	// Goroutines take some time to be released after they return.
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, runtime.NumGoroutine() <= before, "goroutines leaked. Before <%d>, after <%d>", before, runtime.NumGoroutine())
+}
+
+func TestGame_Health(t *testing.T) {
+	cfg := corona.DefaultConfig()
+	cfg.Width, cfg.Height = 1000, 1000
+	game := corona.New(cfg)
+
+	assert.Error(t, game.Health().Live(time.Second))
+
+	game.Init()
+	time.Sleep(200 * time.Millisecond)
+	health := game.Health()
+	assert.NoError(t, health.Live(time.Second))
+	assert.True(t, health.Tick > 0)
+	assert.True(t, health.Goroutines["simulation"])
+	assert.True(t, health.Goroutines["contacts_cookies"])
+	assert.True(t, health.Goroutines["contacts_food"])
+
+	health.FPS = cfg.MinFPS - 1
+	assert.NoError(t, health.Live(time.Second))
+	assert.Error(t, health.Ready(time.Second))
+
+	health.Goroutines["contacts_food"] = false
+	assert.Error(t, health.Live(time.Second))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, game.Shutdown(ctx))
+	assert.Error(t, game.Health().Live(time.Second))
+}
+
+func TestGame_Resume(t *testing.T) {
+	cfg := corona.DefaultConfig()
+	cfg.ResumeGrace = 200 * time.Millisecond
+	game := corona.New(cfg)
+
+	sessionID, outbox := game.NewSession()
+	join, err := game.UserJoin(sessionID, messages.NewUserJoinRequest("manolo"))
+	assert.NoError(t, err)
+	token := join.Data.ResumeToken
+	assert.NotEmpty(t, token)
+
+	connID, connOutbox := game.NewSession()
+	_, _, err = game.Resume(connID, messages.NewResumeRequest(token))
+	assert.Error(t, err, "a connected session cannot be resumed")
+
+	game.Disconnect(sessionID, outbox)
+	info, err := game.Session(sessionID)
+	assert.NoError(t, err)
+	assert.True(t, info.Disconnected)
+
+	forged := []byte(token)
+	forged[10] ^= 1
+	_, _, err = game.Resume(connID, messages.NewResumeRequest(string(forged)))
+	assert.Error(t, err)
+
+	resumedID, resp, err := game.Resume(connID, messages.NewResumeRequest(token))
+	assert.NoError(t, err)
+	assert.Equal(t, sessionID, resumedID)
+	assert.True(t, resp.Data.Ok)
+	assert.NotEmpty(t, resp.Data.ResumeToken)
+	assert.NotEqual(t, token, resp.Data.ResumeToken)
+	_, err = game.Session(connID)
+	assert.Error(t, err, "the session of the new connection is gone")
+	_, err = outbox.Take()
+	assert.Equal(t, sessionmanager.ErrOutboxClosed, err)
+
+	// The old connection closing does not affect the resumed session.
+	game.Disconnect(sessionID, outbox)
+	info, err = game.Session(sessionID)
+	assert.NoError(t, err)
+	assert.False(t, info.Disconnected)
+
+	// Only the last token issued is valid.
+	game.Disconnect(sessionID, connOutbox)
+	connID, _ = game.NewSession()
+	_, _, err = game.Resume(connID, messages.NewResumeRequest(token))
+	assert.Error(t, err)
+
+	// Not resumed in time.
+	time.Sleep(400 * time.Millisecond)
+	_, err = game.Session(sessionID)
+	assert.Error(t, err)
+}
+
+func TestGame_UserJoinProtocol(t *testing.T) {
+	game := corona.New(corona.DefaultConfig())
+
+	sessionID, outbox := game.NewSession()
+	resp, err := game.UserJoin(sessionID, &messages.UserJoinRequest{Username: "manolo"})
+	assert.NoError(t, err)
+	assert.False(t, resp.Data.Ok)
+	assert.NotEmpty(t, resp.Data.Reason)
+	info, err := game.Session(sessionID)
+	assert.NoError(t, err)
+	assert.Equal(t, "not_logged", info.State, "a rejected user can join again with a supported client")
+
+	req := messages.NewUserJoinRequest("manolo")
+	req.Capabilities = []string{messages.CapabilityPing}
+	resp, err = game.UserJoin(sessionID, req)
+	assert.NoError(t, err)
+	assert.True(t, resp.Data.Ok)
+	assert.Equal(t, []string{messages.CapabilityPing}, resp.Data.Capabilities)
+	assert.Empty(t, resp.Data.ResumeToken, "the client does not support resuming")
+
+	game.Disconnect(sessionID, outbox)
+	_, err = game.Session(sessionID)
+	assert.Error(t, err, "a session that cannot be resumed is closed when its connection drops")
+}
+
+func TestGame_ServeErrorResponse(t *testing.T) {
+	game := corona.New(corona.DefaultConfig())
+	serverConn, clientConn := corona.Pipe()
+	sessionID, outbox := game.NewSession()
+	go game.Serve(sessionID, outbox, corona.NewTransport(msgpack.Codec, serverConn, logger.Nop()), logger.Nop())
+	client := corona.NewTransport(msgpack.Codec, clientConn, logger.Nop())
+	defer client.Close()
+
+	create := messages.NewCreateCookieRequest()
+	create.SetRequestID(7)
+	assert.NoError(t, client.Send(create))
+	msg, err := client.Receive()
+	assert.NoError(t, err)
+	errResp, ok := msg.(*messages.ErrorResponse)
+	assert.True(t, ok)
+	assert.Equal(t, messages.ErrorCodeNotLogged, errResp.Code)
+	assert.EqualValues(t, messages.CreateCookieRequestType, errResp.Request)
+	assert.Equal(t, uint64(7), errResp.RequestID, "errors echo the request ID")
+
+	join := messages.NewUserJoinRequest("manolo")
+	join.SetRequestID(8)
+	assert.NoError(t, client.Send(join))
+	msg, err = client.Receive()
+	assert.NoError(t, err)
+	assert.True(t, msg.(*messages.UserJoinResponse).Data.Ok)
+	assert.Equal(t, uint64(8), msg.(*messages.UserJoinResponse).RequestID)
+
+	assert.NoError(t, client.Send(messages.NewUserJoinRequest("manolo")))
+	msg, err = client.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, messages.ErrorCodeAlreadyLogged, msg.(*messages.ErrorResponse).Code)
+}
+
+func TestGame_Errors(t *testing.T) {
+	game := corona.New(corona.DefaultConfig())
+	sessionID, _ := game.NewSession()
+
+	_, err := game.CreateCookie(sessionID, messages.NewCreateCookieRequest())
+	assert.True(t, errors.Is(err, corona.ErrNotLogged))
+	_, err = game.UserJoin(sessionID, messages.NewUserJoinRequest("manolo"))
+	assert.NoError(t, err)
+	_, err = game.UserJoin(sessionID, messages.NewUserJoinRequest("manolo"))
+	assert.True(t, errors.Is(err, corona.ErrAlreadyLogged))
+	_, err = game.UserJoin(sessionID+1, messages.NewUserJoinRequest("manolo"))
+	assert.True(t, errors.Is(err, corona.ErrSessionNotFound))
+}
+
+func TestGame_ViewportAcknowledgesInput(t *testing.T) {
+	cfg := corona.DefaultConfig()
+	cfg.Width, cfg.Height = 1000, 1000
+	cfg.UpdateClientPeriod = 10 * time.Millisecond
+	game := corona.New(cfg)
+	game.Init()
+	defer game.Shutdown(context.Background())
+
+	sessionID, outbox := game.NewSession()
+	_, err := game.UserJoin(sessionID, messages.NewUserJoinRequest("manolo"))
+	assert.NoError(t, err)
+	_, err = game.CreateCookie(sessionID, messages.NewCreateCookieRequest())
+	assert.NoError(t, err)
+	req := messages.NewViewPortRequest(0, 0, 1000, 1000, 0, false)
+	req.Seq = 5
+	game.UpdateViewPortRequest(sessionID, req)
+
+	var resp *messages.ViewportResponse
+	timeout := time.After(2 * time.Second)
+	// The cookie moves once the input is applied.
+	for resp == nil || resp.InputSeq != 5 || (resp.VX == 0 && resp.VY == 0) {
+		select {
+		case <-outbox.Ready():
+		case <-timeout:
+			t.Fatal("input not acknowledged")
+		}
+		msgs, _ := outbox.Take()
+		for _, msg := range msgs {
+			if v, ok := msg.(*messages.ViewportResponse); ok {
+				resp = v
+			}
+		}
+	}
+	assert.NotZero(t, resp.Tick)
+}
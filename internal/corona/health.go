@@ -0,0 +1,57 @@
+package corona
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Health is a snapshot of the simulation used to know if the game is working.
+type Health struct {
+	Running     bool            `json:"running"`
+	Tick        uint64          `json:"tick"`
+	LastTickAge time.Duration   `json:"last_tick_age_ns"`
+	FPS         float64         `json:"fps"`
+	MinFPS      float64         `json:"min_fps"`
+	Goroutines  map[string]bool `json:"goroutines"` // Alive world goroutines by name
+}
+
+// Health returns the state of the simulation goroutines.
+func (g *Game) Health() *Health {
+	return g.world.health()
+}
+
+// Live returns an error if the simulation is not running, has not ticked in
+// the last maxTickAge or any of the world goroutines died.
+func (h *Health) Live(maxTickAge time.Duration) error {
+	if !h.Running {
+		return fmt.Errorf("simulation is not running")
+	}
+	if h.LastTickAge > maxTickAge {
+		return fmt.Errorf("simulation has not ticked for %s", h.LastTickAge)
+	}
+
+	dead := make([]string, 0)
+	for name, alive := range h.Goroutines {
+		if !alive {
+			dead = append(dead, name)
+		}
+	}
+	if len(dead) > 0 {
+		sort.Strings(dead)
+		return fmt.Errorf("world goroutines %v are dead", dead)
+	}
+	return nil
+}
+
+// Ready returns an error if the game is not live or cannot sustain the
+// minimum frame rate, so it should not accept new players.
+func (h *Health) Ready(maxTickAge time.Duration) error {
+	if err := h.Live(maxTickAge); err != nil {
+		return err
+	}
+	if h.FPS < h.MinFPS {
+		return fmt.Errorf("frame rate %.1f is below %.1f", h.FPS, h.MinFPS)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package corona
+
+import (
+	"github.com/x1m3/corona/internal/metrics"
+)
+
+var (
+	metricFPS = metrics.NewGauge(
+		"cookies_simulation_fps",
+		"Current frames per second of the simulation.")
+	metricStepDuration = metrics.NewHistogram(
+		"cookies_simulation_step_seconds",
+		"Time spent running a simulation step.",
+		[]float64{0.001, 0.0025, 0.005, 0.01, 0.02, 0.025, 0.033, 0.05, 0.1, 0.25})
+	metricBodies = metrics.NewGauge(
+		"cookies_world_bodies",
+		"Number of bodies in the world.")
+	metricFood = metrics.NewGauge(
+		"cookies_world_food",
+		"Number of food pieces in the world.")
+	metricSessions = metrics.NewGaugeVec(
+		"cookies_sessions",
+		"Number of sessions by state.",
+		"state")
+	metricResponseQueue = metrics.NewGauge(
+		"cookies_response_queue_depth",
+		"Responses waiting to be sent, summed over all sessions.")
+	metricCollisionQueue = metrics.NewGaugeVec(
+		"cookies_collision_queue_depth",
+		"Collisions waiting to be processed.",
+		"kind")
+	metricMessagesSent = metrics.NewCounterVec(
+		"cookies_messages_sent_total",
+		"Messages sent to clients.",
+		"codec")
+	metricBytesSent = metrics.NewCounterVec(
+		"cookies_bytes_sent_total",
+		"Bytes sent to clients.",
+		"codec")
+	metricBatchesSent = metrics.NewCounter(
+		"cookies_batches_sent_total",
+		"Frames sent to clients with several messages.")
+	metricMessagesReceived = metrics.NewCounterVec(
+		"cookies_messages_received_total",
+		"Messages received from clients.",
+		"codec")
+	metricBytesReceived = metrics.NewCounterVec(
+		"cookies_bytes_received_total",
+		"Bytes received from clients.",
+		"codec")
+	metricMessagesDropped = metrics.NewCounterVec(
+		"cookies_messages_dropped_total",
+		"Messages discarded without being processed or sent.",
+		"reason")
+	metricOutboxOverflows = metrics.NewCounter(
+		"cookies_outbox_overflows_total",
+		"Sessions closed because their client did not keep up with its messages.")
+	metricRTT = metrics.NewHistogram(
+		"cookies_client_rtt_seconds",
+		"Round trip time of pings to clients.",
+		[]float64{0.01, 0.025, 0.05, 0.075, 0.1, 0.15, 0.2, 0.3, 0.5, 1, 2})
+	metricDeaths = metrics.NewCounter(
+		"cookies_deaths_total",
+		"Cookies destroyed by other cookies.")
+	metricProtocolRejections = metrics.NewCounter(
+		"cookies_protocol_rejections_total",
+		"Users rejected on join because their client speaks an unsupported protocol version.")
+	metricViewportFrames = metrics.NewCounterVec(
+		"cookies_viewport_frames_total",
+		"Viewport responses sent, by kind (keyframe or delta).",
+		"kind")
+	metricWebsocketPayloadBytes = metrics.NewCounter(
+		"cookies_websocket_payload_bytes_total",
+		"Bytes of the messages written to websockets, before compression.")
+	metricWebsocketWireBytes = metrics.NewCounter(
+		"cookies_websocket_wire_bytes_total",
+		"Bytes written to the network by websockets, after compression and framing.")
+)
+
+func init() {
+	metrics.Default.Register(
+		metricFPS,
+		metricStepDuration,
+		metricBodies,
+		metricFood,
+		metricSessions,
+		metricResponseQueue,
+		metricCollisionQueue,
+		metricMessagesSent,
+		metricBytesSent,
+		metricBatchesSent,
+		metricMessagesReceived,
+		metricBytesReceived,
+		metricMessagesDropped,
+		metricOutboxOverflows,
+		metricRTT,
+		metricDeaths,
+		metricProtocolRejections,
+		metricViewportFrames,
+		metricWebsocketPayloadBytes,
+		metricWebsocketWireBytes,
+	)
+}
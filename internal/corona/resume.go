@@ -0,0 +1,180 @@
+package corona
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/x1m3/corona/internal/corona/sessionmanager"
+	"github.com/x1m3/corona/internal/messages"
+)
+
+// ErrInvalidResumeToken is returned for resume tokens not issued by the game.
+var ErrInvalidResumeToken = errors.New("invalid resume token")
+
+// resumeTokens issues and verifies the tokens that prove a client owns a
+// session. A token is the session ID and the generation of the token, that
+// changes every time one is issued, followed by their HMAC-SHA256, base64
+// encoded.
+type resumeTokens struct {
+	secret []byte
+}
+
+// graceTimers close the sessions that are not resumed in time. They are
+// stopped on shutdown, that closes the sessions itself.
+type graceTimers struct {
+	mu      sync.Mutex
+	timers  map[uint64]*time.Timer
+	stopped bool
+}
+
+func newGraceTimers() *graceTimers {
+	return &graceTimers{timers: make(map[uint64]*time.Timer)}
+}
+
+// start calls f after d, unless the timers are stopped before. It replaces the
+// timer of the session, if any.
+func (g *graceTimers) start(sessionID uint64, d time.Duration, f func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.stopped {
+		return
+	}
+	if old, ok := g.timers[sessionID]; ok {
+		old.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		g.mu.Lock()
+		if g.stopped || g.timers[sessionID] != timer {
+			g.mu.Unlock()
+			return
+		}
+		delete(g.timers, sessionID)
+		g.mu.Unlock()
+		f()
+	})
+	g.timers[sessionID] = timer
+}
+
+func (g *graceTimers) stop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.stopped = true
+	for sessionID, timer := range g.timers {
+		timer.Stop()
+		delete(g.timers, sessionID)
+	}
+}
+
+// newResumeTokens uses secret to sign tokens. A random one is used if it is
+// empty, so tokens are only valid until the server restarts.
+func newResumeTokens(secret []byte) *resumeTokens {
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			panic(err)
+		}
+	}
+	return &resumeTokens{secret: secret}
+}
+
+func (r *resumeTokens) issue(sessionID, generation uint64) string {
+	token := make([]byte, 16, 16+sha256.Size)
+	binary.BigEndian.PutUint64(token, sessionID)
+	binary.BigEndian.PutUint64(token[8:], generation)
+	return base64.RawURLEncoding.EncodeToString(append(token, r.sign(token)...))
+}
+
+func (r *resumeTokens) verify(token string) (sessionID, generation uint64, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(data) != 16+sha256.Size {
+		return 0, 0, ErrInvalidResumeToken
+	}
+	if !hmac.Equal(data[16:], r.sign(data[:16])) {
+		return 0, 0, ErrInvalidResumeToken
+	}
+	return binary.BigEndian.Uint64(data[:8]), binary.BigEndian.Uint64(data[8:16]), nil
+}
+
+func (r *resumeTokens) sign(data []byte) []byte {
+	mac := hmac.New(sha256.New, r.secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Disconnect is called when the connection of a session drops. outbox is the
+// one of that connection. A user that joined with the resume capability keeps
+// the session, and its cookie, for the resume grace period, so it can be
+// resumed on a new connection. Otherwise, the session is closed.
+func (g *Game) Disconnect(sessionID uint64, outbox *sessionmanager.Outbox) {
+	resumable, err := g.gSessions.Disconnect(sessionID, outbox)
+	if err != nil {
+		// Already closed, or resumed by another connection.
+		return
+	}
+	if capable, _ := g.gSessions.HasCapability(sessionID, messages.CapabilityResume); !capable {
+		resumable = false
+	}
+	if !resumable || g.resumeGrace <= 0 {
+		g.Logout(sessionID)
+		return
+	}
+
+	g.log.Info("Session disconnected, waiting to be resumed", "session", sessionID, "grace", g.resumeGrace)
+	g.graceTimers.start(sessionID, g.resumeGrace, func() {
+		// It may have been resumed in the meantime.
+		if g.gSessions.DisconnectedFor(sessionID, g.resumeGrace) {
+			g.log.Info("Session not resumed in time", "session", sessionID)
+			g.Logout(sessionID)
+		}
+	})
+}
+
+// issueResumeToken returns a new resume token for a session, and invalidates
+// the previous ones.
+func (g *Game) issueResumeToken(sessionID uint64) (string, error) {
+	generation, err := g.gSessions.NextResumeGeneration(sessionID)
+	if err != nil {
+		return "", err
+	}
+	return g.resume.issue(sessionID, generation), nil
+}
+
+// Resume moves the connection of connSessionID, a session that did not join,
+// to the disconnected session that issued the token. It returns the ID of the
+// resumed session, that the connection must use from now on. The response
+// carries a new token, as the used one is no longer valid.
+func (g *Game) Resume(connSessionID uint64, req *messages.ResumeRequest) (uint64, *messages.ResumeResponse, error) {
+	sessionID, generation, err := g.resume.verify(req.Token)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := g.gSessions.Resume(sessionID, connSessionID, generation); err != nil {
+		return 0, nil, err
+	}
+	token, err := g.issueResumeToken(sessionID)
+	if err != nil {
+		return 0, nil, err
+	}
+	// The new connection has no frames to build deltas on.
+	g.world.views.remove(sessionID)
+	g.world.views.remove(connSessionID)
+
+	cookie := messages.CookieInfo{}
+	if playing, _ := g.gSessions.IsPlaying(sessionID); playing {
+		if info, err := g.Session(sessionID); err == nil {
+			cookie = messages.CookieInfo{ID: sessionID, Score: info.Score, X: float32(info.X), Y: float32(info.Y)}
+		}
+	}
+	resp := messages.NewResumeResponse(true, cookie)
+	resp.Data.ResumeToken = token
+	return sessionID, resp, nil
+}
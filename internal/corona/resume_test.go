@@ -0,0 +1,27 @@
+package corona
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGraceTimers(t *testing.T) {
+	timers := newGraceTimers()
+	var calls int32
+	f := func() { atomic.AddInt32(&calls, 1) }
+
+	// A new grace period replaces the previous one of the session.
+	timers.start(1, 50*time.Millisecond, f)
+	timers.start(1, 50*time.Millisecond, f)
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	timers.start(1, 50*time.Millisecond, f)
+	timers.stop()
+	timers.start(2, 50*time.Millisecond, f)
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "stopped timers do not fire")
+}
@@ -0,0 +1,101 @@
+package corona
+
+import (
+	"github.com/x1m3/corona/internal/corona/sessionmanager"
+	"github.com/x1m3/corona/internal/logger"
+	"github.com/x1m3/corona/internal/messages"
+)
+
+// Serve runs a session for a client connected through transport, with the
+// outbox returned by NewSession. It returns once the connection is closed.
+func (g *Game) Serve(sessionID uint64, outbox *sessionmanager.Outbox, transport *Transport, log *logger.Logger) {
+	go g.sendResponses(transport, outbox, log)
+	g.handleRequests(transport, sessionID, outbox, log)
+}
+
+// sendResponses sends the messages queued for the client. It is the only
+// writer of the connection. Closing the session is left to handleRequests,
+// that notices when the connection is closed.
+func (g *Game) sendResponses(transport *Transport, outbox *sessionmanager.Outbox, log *logger.Logger) {
+	for range outbox.Ready() {
+		msgs, err := outbox.Take()
+		if sendErr := send(transport, msgs, outbox.Batched()); sendErr != nil {
+			log.Warn("Socket broken while writing. Closing connection", "err", sendErr)
+			transport.Close()
+			return
+		}
+		switch err {
+		case nil:
+			continue
+		case sessionmanager.ErrOutboxOverflow:
+			log.Warn("Client too slow. Closing connection")
+		}
+		// Session closed by the game or resumed by another connection, once
+		// its last messages are sent.
+		transport.Close()
+		return
+	}
+}
+
+func send(transport *Transport, msgs []interface{}, batch bool) error {
+	if batch && len(msgs) > 1 {
+		batched := make([]messages.Message, 0, len(msgs))
+		for _, msg := range msgs {
+			batched = append(batched, msg.(messages.Message))
+		}
+		return transport.SendBatch(batched)
+	}
+	for _, msg := range msgs {
+		if err := transport.Send(msg.(messages.Message)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *Game) handleRequests(transport *Transport, sessionID uint64, outbox *sessionmanager.Outbox, log *logger.Logger) {
+	dispatcher := g.dispatcher
+	for {
+		msg, err := transport.Receive()
+		if err != nil {
+			log.Info("Closing connection", "err", err)
+			g.Disconnect(sessionID, outbox)
+			transport.Close()
+			return
+		}
+
+		// Resuming changes the session of the connection, so it is not left to the dispatcher.
+		if req, ok := msg.(*messages.ResumeRequest); ok {
+			resumedID, resp, err := g.Resume(sessionID, req)
+			if err != nil {
+				log.Warn("Cannot resume session", "err", err)
+				resp = messages.NewResumeResponse(false, messages.CookieInfo{})
+			} else {
+				log.Info("Session resumed", "resumed_session", resumedID)
+				sessionID, log = resumedID, log.With("resumed_session", resumedID)
+			}
+			messages.Correlate(req, resp)
+			outbox.Push(resp)
+			outbox.Flush()
+			continue
+		}
+
+		resp, errResp := dispatcher.Dispatch(sessionID, msg)
+		if errResp == ErrUnknownMessage {
+			log.Warn("Got unknown message type", "msg_type", msg.GetType())
+		} else if errResp != nil {
+			log.Warn("Error handling request", "msg_type", msg.GetType(), "err", errResp)
+		}
+		if errResp != nil {
+			resp = errorResponse(msg, errResp)
+		}
+		if resp != nil {
+			messages.Correlate(msg, resp)
+		}
+		if resp != nil && outbox.Push(resp) != sessionmanager.Queued {
+			log.Warn("Cannot queue response", "msg_type", resp.GetType())
+		}
+		// Responses are not held until the end of the simulation step.
+		outbox.Flush()
+	}
+}
@@ -0,0 +1,89 @@
+package sessionmanager
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrUnexpectedPong is returned for pongs that do not answer the last ping.
+var ErrUnexpectedPong = errors.New("pong does not match the last ping")
+
+// latency measures the round trip time to a client with pings, smoothed as
+// TCP does (RFC 6298).
+type latency struct {
+	pingID   uint64    // last ping sent
+	pingSent time.Time // zero once answered
+	srtt     time.Duration
+	jitter   time.Duration // mean deviation of the round trip time
+	samples  uint64
+}
+
+func (l *latency) ping(now time.Time) uint64 {
+	l.pingID++
+	l.pingSent = now
+	return l.pingID
+}
+
+// pong records the answer to a ping and returns its round trip time. Only the
+// last ping is answered, older ones are outdated.
+func (l *latency) pong(pingID uint64, now time.Time) (time.Duration, error) {
+	if pingID != l.pingID || l.pingSent.IsZero() {
+		return 0, ErrUnexpectedPong
+	}
+	rtt := now.Sub(l.pingSent)
+	l.pingSent = time.Time{}
+
+	if l.samples == 0 {
+		l.srtt, l.jitter = rtt, rtt/2
+	} else {
+		deviation := l.srtt - rtt
+		if deviation < 0 {
+			deviation = -deviation
+		}
+		l.jitter = (3*l.jitter + deviation) / 4
+		l.srtt = (7*l.srtt + rtt) / 8
+	}
+	l.samples++
+	return rtt, nil
+}
+
+// Ping starts a round trip time measure, and returns the ID the client must
+// answer with and the latency measured so far. Disconnected sessions return
+// ErrDisconnected.
+func (s *Sessions) Ping(id uint64) (pingID uint64, srtt, jitter time.Duration, err error) {
+	_, err = s.ensure(
+		id,
+		func() gameSessionFunc {
+			return func(session *gameSession) (interface{}, error) {
+				if !session.disconnectedAt.IsZero() {
+					return nil, ErrDisconnected
+				}
+				pingID = session.latency.ping(time.Now())
+				srtt, jitter = session.latency.srtt, session.latency.jitter
+				return nil, nil
+			}
+		}(),
+		WriteMode)
+	return pingID, srtt, jitter, err
+}
+
+// Pong records the answer of the client to a ping, and returns the round trip time.
+func (s *Sessions) Pong(id uint64, pingID uint64) (time.Duration, error) {
+	rtt, err := s.ensure(
+		id,
+		func() gameSessionFunc {
+			return func(session *gameSession) (interface{}, error) {
+				return session.latency.pong(pingID, time.Now())
+			}
+		}(),
+		WriteMode)
+	if err != nil {
+		return 0, err
+	}
+	return rtt.(time.Duration), nil
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
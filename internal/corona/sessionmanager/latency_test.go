@@ -0,0 +1,56 @@
+package sessionmanager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/x1m3/corona/internal/logger"
+)
+
+func TestLatency(t *testing.T) {
+	var l latency
+	now := time.Now()
+
+	_, err := l.pong(0, now)
+	assert.Error(t, err, "pong without ping")
+
+	id := l.ping(now)
+	rtt, err := l.pong(id, now.Add(100*time.Millisecond))
+	assert.NoError(t, err)
+	assert.Equal(t, 100*time.Millisecond, rtt)
+	assert.Equal(t, 100*time.Millisecond, l.srtt)
+	assert.Equal(t, 50*time.Millisecond, l.jitter)
+
+	_, err = l.pong(id, now.Add(200*time.Millisecond))
+	assert.Error(t, err, "answered twice")
+
+	old := l.ping(now)
+	id = l.ping(now)
+	_, err = l.pong(old, now.Add(time.Millisecond))
+	assert.Error(t, err, "outdated ping")
+
+	_, err = l.pong(id, now.Add(180*time.Millisecond))
+	assert.NoError(t, err)
+	assert.Equal(t, 110*time.Millisecond, l.srtt)
+	assert.Equal(t, 57500*time.Microsecond, l.jitter)
+}
+
+func TestSessions_Ping(t *testing.T) {
+	s := New(logger.Nop(), 16, time.Second)
+	id := s.Add()
+
+	pingID, srtt, _, err := s.Ping(id)
+	assert.NoError(t, err)
+	assert.Zero(t, srtt)
+	_, err = s.Pong(id, pingID)
+	assert.NoError(t, err)
+
+	info, err := s.Info(id)
+	assert.NoError(t, err)
+	assert.True(t, info.RTT > 0)
+
+	_, _, _, err = s.Ping(id + 1)
+	assert.Error(t, err)
+}
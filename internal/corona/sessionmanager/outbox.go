@@ -0,0 +1,173 @@
+package sessionmanager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrOutboxClosed is returned by Outbox.Take once the session is closed.
+var ErrOutboxClosed = errors.New("outbox closed")
+
+// ErrOutboxOverflow is returned by Outbox.Take when the client did not keep
+// up with its messages for too long. The session should be closed.
+var ErrOutboxOverflow = errors.New("outbox overflow, client too slow")
+
+// PushResult tells what happened to a message pushed to an outbox.
+type PushResult int
+
+const (
+	Queued     PushResult = iota
+	Superseded            // it replaced a message that was still pending
+	Dropped               // the outbox was full
+	Overflowed            // the outbox was full for too long, and is now closed
+	Closed                // the outbox was already closed
+)
+
+// Outbox holds the messages waiting to be sent to the client of a session.
+// Pushing never blocks, so a slow client cannot stall the simulation.
+//
+// A message added with Replace supersedes the previous one added with Replace
+// if it was not taken yet, keeping its place in the queue. This is used for
+// viewport updates, where only the latest one matters.
+//
+// A batched outbox holds the messages pushed until Flush, so they can be sent
+// in a single frame.
+type Outbox struct {
+	sync.Mutex
+	queue         []interface{}
+	latest        int // position of the replaceable message in queue, -1 if none
+	size          int
+	maxOverflow   time.Duration
+	overflowSince time.Time
+	err           error
+	batched       bool
+	ready         chan struct{}
+	now           func() time.Time
+}
+
+// NewOutbox returns an outbox for size messages. Messages pushed while it is
+// full are dropped, and once it is full for longer than maxOverflow it is
+// closed with ErrOutboxOverflow.
+func NewOutbox(size int, maxOverflow time.Duration) *Outbox {
+	return &Outbox{
+		latest:      -1,
+		size:        size,
+		maxOverflow: maxOverflow,
+		ready:       make(chan struct{}, 1),
+		now:         time.Now,
+	}
+}
+
+// SetBatched makes the outbox hold the messages pushed until Flush. By
+// default, the reader is woken up on every push.
+func (o *Outbox) SetBatched(batched bool) {
+	o.Lock()
+	o.batched = batched
+	o.Unlock()
+}
+
+// Batched returns true if the outbox holds the messages pushed until Flush.
+func (o *Outbox) Batched() bool {
+	o.Lock()
+	defer o.Unlock()
+	return o.batched
+}
+
+// Flush wakes up the reader if there is something to take.
+func (o *Outbox) Flush() {
+	o.Lock()
+	if len(o.queue) > 0 {
+		o.signal()
+	}
+	o.Unlock()
+}
+
+// Push adds a message at the end of the queue.
+func (o *Outbox) Push(msg interface{}) PushResult {
+	return o.push(msg, false)
+}
+
+// Replace adds a message that supersedes the previous pending one added with Replace.
+func (o *Outbox) Replace(msg interface{}) PushResult {
+	return o.push(msg, true)
+}
+
+func (o *Outbox) push(msg interface{}, replace bool) PushResult {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.err != nil {
+		return Closed
+	}
+	if replace && o.latest >= 0 {
+		o.queue[o.latest] = msg
+		return Superseded
+	}
+	if len(o.queue) >= o.size {
+		now := o.now()
+		if o.overflowSince.IsZero() {
+			o.overflowSince = now
+		}
+		if now.Sub(o.overflowSince) < o.maxOverflow {
+			return Dropped
+		}
+		o.queue, o.latest = nil, -1
+		o.err = ErrOutboxOverflow
+		o.signal()
+		return Overflowed
+	}
+
+	if replace {
+		o.latest = len(o.queue)
+	}
+	o.queue = append(o.queue, msg)
+	if !o.batched {
+		o.signal()
+	}
+	return Queued
+}
+
+// Ready returns a channel that receives a value when there is something to take.
+func (o *Outbox) Ready() <-chan struct{} {
+	return o.ready
+}
+
+// Take returns all pending messages, oldest first, and empties the outbox.
+// Once the outbox is closed, it returns the last messages to send along with
+// ErrOutboxClosed, or ErrOutboxOverflow and no messages if the client was too slow.
+func (o *Outbox) Take() ([]interface{}, error) {
+	o.Lock()
+	msgs := o.queue
+	o.queue, o.latest = nil, -1
+	o.overflowSince = time.Time{}
+	err := o.err
+	o.Unlock()
+	return msgs, err
+}
+
+// Len returns the number of pending messages.
+func (o *Outbox) Len() int {
+	o.Lock()
+	defer o.Unlock()
+	return len(o.queue)
+}
+
+// Close stops accepting messages. The pending ones can still be taken.
+func (o *Outbox) Close() {
+	o.Lock()
+	if o.err == nil {
+		o.err = ErrOutboxClosed
+	}
+	o.signal()
+	o.Unlock()
+}
+
+// signal wakes up the reader, if it is not already awake. Must be called with the lock held.
+func (o *Outbox) signal() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,100 @@
+package sessionmanager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutbox(t *testing.T) {
+	o := NewOutbox(3, time.Second)
+
+	assert.Equal(t, Queued, o.Replace("view 1"))
+	assert.Equal(t, Queued, o.Push("stats"))
+	assert.Equal(t, Superseded, o.Replace("view 2"))
+	assert.Equal(t, 2, o.Len())
+
+	select {
+	case <-o.Ready():
+	default:
+		t.Fatal("outbox not ready")
+	}
+	msgs, err := o.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"view 2", "stats"}, msgs)
+
+	// Once taken, a viewport does not replace anything.
+	assert.Equal(t, Queued, o.Replace("view 3"))
+	assert.Equal(t, Queued, o.Push("join"))
+
+	o.Close()
+	assert.Equal(t, Closed, o.Push("late"))
+	msgs, err = o.Take()
+	assert.Equal(t, ErrOutboxClosed, err)
+	assert.Equal(t, []interface{}{"view 3", "join"}, msgs)
+	msgs, err = o.Take()
+	assert.Equal(t, ErrOutboxClosed, err)
+	assert.Empty(t, msgs)
+}
+
+func TestOutbox_Overflow(t *testing.T) {
+	now := time.Now()
+	o := NewOutbox(2, time.Second)
+	o.now = func() time.Time { return now }
+
+	o.Push(1)
+	o.Push(2)
+	assert.Equal(t, Dropped, o.Push(3))
+	now = now.Add(500 * time.Millisecond)
+	assert.Equal(t, Dropped, o.Push(4))
+
+	// Taking resets the overflow.
+	msgs, err := o.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{1, 2}, msgs)
+
+	o.Push(5)
+	o.Push(6)
+	assert.Equal(t, Dropped, o.Push(7))
+	now = now.Add(time.Second)
+	assert.Equal(t, Overflowed, o.Push(8))
+	assert.Equal(t, Closed, o.Push(9))
+
+	msgs, err = o.Take()
+	assert.Equal(t, ErrOutboxOverflow, err)
+	assert.Empty(t, msgs)
+}
+
+func TestOutbox_Batched(t *testing.T) {
+	o := NewOutbox(3, time.Second)
+	o.SetBatched(true)
+
+	o.Flush()
+	o.Push("stats")
+	o.Replace("view")
+	select {
+	case <-o.Ready():
+		t.Fatal("messages not held until flushed")
+	default:
+	}
+
+	o.Flush()
+	select {
+	case <-o.Ready():
+	default:
+		t.Fatal("outbox not ready once flushed")
+	}
+	msgs, err := o.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"stats", "view"}, msgs)
+
+	// Closing does not wait for a flush.
+	o.Push("join")
+	o.Close()
+	select {
+	case <-o.Ready():
+	default:
+		t.Fatal("outbox not ready once closed")
+	}
+}
@@ -0,0 +1,116 @@
+package sessionmanager
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Errors returned when resuming and disconnecting sessions.
+var (
+	ErrNotResumable       = errors.New("session cannot be resumed")
+	ErrSessionJoined      = errors.New("session already joined")
+	ErrConnectionReplaced = errors.New("session was resumed by another connection")
+	ErrDisconnected       = errors.New("session disconnected, waiting to be resumed")
+)
+
+// Disconnect records that the connection of a session dropped. outbox is the
+// one of that connection. It returns true if the session can be resumed, that
+// is, if the user joined. The cookie keeps coasting, without turbo. Nobody
+// reads outbox any more, so it is closed and messages for the session are
+// dropped until it is resumed.
+func (s *Sessions) Disconnect(id uint64, outbox *Outbox) (resumable bool, err error) {
+	v, err := s.ensure(
+		id,
+		func() gameSessionFunc {
+			return func(session *gameSession) (interface{}, error) {
+				if session.outbox != outbox {
+					return false, ErrConnectionReplaced
+				}
+				if !session.inLoggedState() && !session.inPlayingState() {
+					return false, nil
+				}
+				session.disconnectedAt = time.Now()
+				session.viewportRequest.Turbo = false
+				session.outbox.Close()
+				return true, nil
+			}
+		}(),
+		WriteMode)
+	if err != nil {
+		return false, err
+	}
+	return v.(bool), nil
+}
+
+// DisconnectedFor returns true if the session has been disconnected for at least d.
+func (s *Sessions) DisconnectedFor(id uint64, d time.Duration) bool {
+	v, err := s.ensure(
+		id,
+		func() gameSessionFunc {
+			return func(session *gameSession) (interface{}, error) {
+				return !session.disconnectedAt.IsZero() && time.Since(session.disconnectedAt) >= d, nil
+			}
+		}(),
+		ReadMode)
+	return err == nil && v.(bool)
+}
+
+// NextResumeGeneration invalidates the resume tokens issued to a session, and
+// returns the generation of the next one.
+func (s *Sessions) NextResumeGeneration(id uint64) (uint64, error) {
+	v, err := s.ensure(
+		id,
+		func() gameSessionFunc {
+			return func(session *gameSession) (interface{}, error) {
+				session.resumeGeneration++
+				return session.resumeGeneration, nil
+			}
+		}(),
+		WriteMode)
+	if err != nil {
+		return 0, err
+	}
+	return v.(uint64), nil
+}
+
+// Resume attaches the connection of the session newID, that must not have
+// joined, to the session id, with a token of the given generation. The
+// session must be disconnected, waiting to be resumed, and the token the last
+// one issued. The outbox of id is closed, so its connection, if it is still
+// open, is closed once the pending messages are sent. Session newID is removed.
+func (s *Sessions) Resume(id uint64, newID uint64, generation uint64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	session, found := s.sessions[id]
+	if !found {
+		return ErrSessionNotFound
+	}
+	fresh, found := s.sessions[newID]
+	if !found {
+		return ErrSessionNotFound
+	}
+	if !session.inLoggedState() && !session.inPlayingState() {
+		return ErrNotResumable
+	}
+	if session.disconnectedAt.IsZero() || generation != session.resumeGeneration {
+		return ErrNotResumable
+	}
+	if _, ok := fresh.state.(*notLoggedState); !ok || id == newID {
+		return ErrSessionJoined
+	}
+
+	session.outbox.Close()
+	fresh.outbox.SetBatched(session.outbox.Batched())
+	session.outbox = fresh.outbox
+	session.codec = fresh.codec
+	session.remoteAddr = fresh.remoteAddr
+	session.traffic = fresh.traffic
+	session.latency = latency{}
+	session.disconnectedAt = time.Time{}
+	delete(s.sessions, newID)
+
+	s.log.Debug("Session resumed", "session", id, "connection_session", newID)
+	return nil
+}
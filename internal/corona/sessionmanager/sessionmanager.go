@@ -8,15 +8,51 @@ import (
 
 	"github.com/ByteArena/box2d"
 	"github.com/pkg/errors"
+
+	"github.com/x1m3/corona/internal/logger"
 )
 
 type Viewport struct {
-	X     float32
-	Y     float32
-	XX    float32
-	YY    float32
-	Angle float32
-	Turbo bool
+	X         float32
+	Y         float32
+	XX        float32
+	YY        float32
+	Angle     float32
+	Turbo     bool
+	Seq       uint64 // of the last input received
+	Processed uint64 // Seq of the last input applied by the simulation
+}
+
+// SessionInfo is a snapshot of the public data of a session.
+type SessionInfo struct {
+	ID         uint64 `json:"id"`
+	Username   string `json:"username"`
+	State      string `json:"state"`
+	Score      uint64 `json:"score"`
+	Codec      string `json:"codec"`
+	RemoteAddr string `json:"remote_addr"`
+
+	Disconnected bool `json:"disconnected"` // Waiting to be resumed by a new connection
+
+	BytesSent        uint64  `json:"bytes_sent"`        // Encoded messages, before compression
+	WireBytesSent    uint64  `json:"wire_bytes_sent"`   // Written to the network
+	CompressionRatio float64 `json:"compression_ratio"` // WireBytesSent / BytesSent. Zero if nothing was sent
+
+	RTT    float64 `json:"rtt_ms"`    // Smoothed round trip time. Zero until the client answers a ping
+	Jitter float64 `json:"jitter_ms"` // Mean deviation of the round trip time
+}
+
+// GameStats are the stats of the cookie a session is playing with.
+type GameStats struct {
+	TimeAlive time.Duration
+	FoodEaten uint64
+}
+
+// TrafficCounter reports the bytes sent to the client of a session.
+type TrafficCounter interface {
+	// Traffic returns the bytes of the messages sent and the bytes written to
+	// the network for them, after compression and framing.
+	Traffic() (payload, wire uint64)
 }
 
 type ViewPortResponse struct {
@@ -24,10 +60,15 @@ type ViewPortResponse struct {
 	Food    []*box2d.B2Body
 }
 
-var errSessionNotFound = errors.New("session not found")
-var errViewportResponseEmpty = errors.New("viewportresponse is still empty")
-var errUserWasLogged = errors.New("user already logged")
-var errCannotSendScreenUpdates = errors.New("cannot send screen updates")
+// Errors returned by Sessions, so callers can tell them apart.
+var (
+	ErrSessionNotFound         = errors.New("session not found")
+	ErrViewportResponseEmpty   = errors.New("viewportresponse is still empty")
+	ErrAlreadyLogged           = errors.New("user already logged")
+	ErrNotLogged               = errors.New("not logged user wants to play")
+	ErrNotPlaying              = errors.New("not playing user wants to stop playing")
+	ErrCannotSendScreenUpdates = errors.New("cannot send screen updates")
+)
 
 const ReadMode = 1
 const WriteMode = 2
@@ -37,37 +78,45 @@ type gameSessionFunc func(s *gameSession) (interface{}, error)
 type gameSession struct {
 	ID                          uint64
 	userName                    string
+	capabilities                []string // optional protocol features supported by the client
+	codec                       string
+	remoteAddr                  string
+	traffic                     TrafficCounter
+	latency                     latency
+	disconnectedAt              time.Time // zero while connected
+	resumeGeneration            uint64    // of the last resume token issued
+	playingSince                time.Time
+	foodEaten                   uint64 // since playing
 	score                       uint64
 	state                       state
 	viewportRequest             Viewport
 	lastViewportResponseRequest time.Time
-	responseCh                  chan interface{}
-	endOfGameCh                 chan interface{}
+	outbox                      *Outbox
 	box2dbody                   *box2d.B2Body
 }
 
-func newGameSession(id uint64) *gameSession {
+func newGameSession(id uint64, outbox *Outbox) *gameSession {
 	return &gameSession{
 		ID:                          id,
 		state:                       &notLoggedState{},
 		score:                       100,
 		lastViewportResponseRequest: time.Now(),
-		responseCh:                  make(chan interface{}, 1024),
-		endOfGameCh:                 make(chan interface{}, 256), // we do not want to block
+		outbox:                      outbox,
 	}
 }
 
 func (s *gameSession) getViewportRequest() (*Viewport, error) {
 
 	if !s.state.canSendScreenUpdates() {
-		return nil, errCannotSendScreenUpdates
+		return nil, ErrCannotSendScreenUpdates
 	}
 
 	return &s.viewportRequest, nil
 }
 
-func (s *gameSession) updateViewportRequest(x, y, xx, yy float32, a float32, t bool) {
+func (s *gameSession) updateViewportRequest(x, y, xx, yy float32, a float32, t bool, seq uint64) {
 	if s.state.canSendScreenUpdates() {
+		s.viewportRequest.Seq = seq
 		s.viewportRequest.X = x
 		s.viewportRequest.Y = y
 		s.viewportRequest.XX = xx
@@ -77,14 +126,15 @@ func (s *gameSession) updateViewportRequest(x, y, xx, yy float32, a float32, t b
 	}
 }
 
-func (s *gameSession) login(username string) error {
+func (s *gameSession) login(username string, capabilities []string) error {
 
 	if s.inLoggedState() {
-		return errUserWasLogged
+		return ErrAlreadyLogged
 	}
 
 	s.state = &loggedState{}
 	s.userName = username
+	s.capabilities = capabilities
 
 	return nil
 }
@@ -103,9 +153,11 @@ func (s *gameSession) inPlayingState() bool {
 func (s *gameSession) startPlaying() error {
 
 	if _, ok := s.state.(*loggedState); !ok {
-		return errors.New("not logged user wants to play")
+		return ErrNotLogged
 	}
 	s.state = &playingState{}
+	s.playingSince = time.Now()
+	s.foodEaten = 0
 
 	return nil
 }
@@ -113,7 +165,7 @@ func (s *gameSession) startPlaying() error {
 func (s *gameSession) stopPlaying() error {
 
 	if _, ok := s.state.(*playingState); !ok {
-		return errors.New("not playing user wants to stop playing")
+		return ErrNotPlaying
 	}
 
 	s.state = &loggedState{}
@@ -143,20 +195,30 @@ func (s *gameSession) getBox2DBody() *box2d.B2Body {
 
 type Sessions struct {
 	sync.RWMutex
-	sessions map[uint64]*gameSession
+	sessions          map[uint64]*gameSession
+	log               *logger.Logger
+	outboxSize        int
+	outboxMaxOverflow time.Duration
 }
 
-func New() *Sessions {
+// New returns an empty set of sessions. Every session can have outboxSize
+// messages waiting to be sent, and is closed if it is full for longer than
+// outboxMaxOverflow.
+func New(log *logger.Logger, outboxSize int, outboxMaxOverflow time.Duration) *Sessions {
 	return &Sessions{
-		sessions: make(map[uint64]*gameSession),
+		sessions:          make(map[uint64]*gameSession),
+		log:               log,
+		outboxSize:        outboxSize,
+		outboxMaxOverflow: outboxMaxOverflow,
 	}
 }
 
 func (s *Sessions) Add() uint64 {
 	ID := rand.Uint64() << 8 // Javascript does not support number larger than 57 bits. Let's avoid problems.
 	s.Lock()
-	s.sessions[ID] = newGameSession(ID)
+	s.sessions[ID] = newGameSession(ID, NewOutbox(s.outboxSize, s.outboxMaxOverflow))
 	s.Unlock()
+	s.log.Debug("Session created", "session", ID)
 	return ID
 }
 
@@ -165,10 +227,9 @@ func (s *Sessions) Close(id uint64) error {
 		id,
 		func() gameSessionFunc {
 			return func(session *gameSession) (interface{}, error) {
-				close(s.sessions[id].responseCh)
-				s.sessions[id].endOfGameCh <- true
-				close(s.sessions[id].endOfGameCh)
+				s.sessions[id].outbox.Close()
 				delete(s.sessions, session.ID)
+				s.log.Debug("Session closed", "session", id, "username", session.userName)
 				return nil, nil
 			}
 		}(),
@@ -184,18 +245,65 @@ func (s *Sessions) Count() uint64 {
 	return uint64(c)
 }
 
-func (s *Sessions) Login(id uint64, username string) error {
+// Stats contains aggregated data about all sessions.
+type Stats struct {
+	ByState        map[string]uint64
+	ResponseQueued uint64 // responses waiting in the outboxes
+}
+
+func (s *Sessions) Stats() *Stats {
+	stats := &Stats{ByState: make(map[string]uint64)}
+
+	s.RLock()
+	for _, session := range s.sessions {
+		stats.ByState[session.state.String()]++
+		stats.ResponseQueued += uint64(session.outbox.Len())
+	}
+	s.RUnlock()
+
+	return stats
+}
+
+// Login joins the user of a session, whose client supports the given optional
+// protocol features.
+func (s *Sessions) Login(id uint64, username string, capabilities []string) error {
 	_, err := s.ensure(
 		id,
 		func() gameSessionFunc {
 			return func(session *gameSession) (interface{}, error) {
-				return nil, session.login(username)
+				if err := session.login(username, capabilities); err != nil {
+					return nil, err
+				}
+				s.log.Debug("User logged", "session", id, "username", username)
+				return nil, nil
 			}
 		}(),
 		WriteMode)
 	return err
 }
 
+// HasCapability tells if the client of a session supports an optional
+// protocol feature. Clients that did not join yet support none.
+func (s *Sessions) HasCapability(id uint64, capability string) (bool, error) {
+	found, err := s.ensure(
+		id,
+		func() gameSessionFunc {
+			return func(session *gameSession) (interface{}, error) {
+				for _, c := range session.capabilities {
+					if c == capability {
+						return true, nil
+					}
+				}
+				return false, nil
+			}
+		}(),
+		ReadMode)
+	if err != nil {
+		return false, err
+	}
+	return found.(bool), nil
+}
+
 func (s *Sessions) GetCookieBody(id uint64) (*box2d.B2Body, error) {
 	body, err := s.ensure(
 		id,
@@ -239,55 +347,62 @@ func (s *Sessions) GetViewportRequest(id uint64) (*Viewport, error) {
 	return v.(*Viewport), err
 }
 
-func (s *Sessions) GetResponseChannel(id uint64) (chan interface{}, error) {
+// ApplyInput returns the last input of a client, for the simulation to apply
+// it, and records it as processed.
+func (s *Sessions) ApplyInput(id uint64) (Viewport, error) {
 	v, err := s.ensure(
 		id,
 		func() gameSessionFunc {
 			return func(session *gameSession) (interface{}, error) {
-				return session.responseCh, nil
+				viewport, err := session.getViewportRequest()
+				if err != nil {
+					return nil, err
+				}
+				viewport.Processed = viewport.Seq
+				return *viewport, nil
 			}
 		}(),
-		ReadMode)
+		WriteMode)
 	if err != nil {
-		return nil, err
+		return Viewport{}, err
 	}
-	return v.(chan interface{}), err
+	return v.(Viewport), nil
 }
 
-func (s *Sessions) GetEndOfGameChannel(id uint64) (chan interface{}, error) {
+func (s *Sessions) GetOutbox(id uint64) (*Outbox, error) {
 	v, err := s.ensure(
 		id,
 		func() gameSessionFunc {
 			return func(session *gameSession) (interface{}, error) {
-				return session.endOfGameCh, nil
+				return session.outbox, nil
 			}
 		}(),
 		ReadMode)
 	if err != nil {
 		return nil, err
 	}
-	return v.(chan interface{}), err
+	return v.(*Outbox), err
 }
 
 // GetViewportRequestEnhanced is a spagheti code version optimized for speed
 // that does the same as calling all of this:
 // ShouldUpdateViewportResponse(),
 // GetViewportRequest()
-// GetViewportResponseChannel()
+// GetOutbox()
 // UpdateLastViewportRequestTime()
 //
 // Thanks to this speed optimization we avoid transversing sessions map 4 times and we
 // only lock the sessions system once,
-func (s *Sessions) GetViewportRequestEnhanced(id uint64, updatePeriod time.Duration) (needsUpdate bool, v *Viewport, ch chan interface{}, err error) {
+func (s *Sessions) GetViewportRequestEnhanced(id uint64, updatePeriod time.Duration) (needsUpdate bool, v *Viewport, outbox *Outbox, err error) {
 	s.RLock()
 
 	session, found := s.sessions[id]
 	if !found {
 		s.RUnlock()
-		return false, nil, nil, errSessionNotFound
+		return false, nil, nil, ErrSessionNotFound
 	}
 
-	if time.Since(session.lastViewportResponseRequest) < updatePeriod {
+	if time.Since(session.lastViewportResponseRequest) < updatePeriod || !session.disconnectedAt.IsZero() {
 		s.RUnlock()
 		return false, nil, nil, nil
 	}
@@ -301,7 +416,7 @@ func (s *Sessions) GetViewportRequestEnhanced(id uint64, updatePeriod time.Durat
 	session.lastViewportResponseRequest = time.Now()
 
 	s.RUnlock()
-	return true, v, session.responseCh, nil
+	return true, v, session.outbox, nil
 }
 
 func (s *Sessions) IsLogged(id uint64) (bool, error) {
@@ -350,7 +465,6 @@ func (s *Sessions) StopPlaying(id uint64) error {
 		id,
 		func() gameSessionFunc {
 			return func(session *gameSession) (interface{}, error) {
-				session.endOfGameCh <- true
 				return nil, session.stopPlaying()
 			}
 		}(),
@@ -371,12 +485,14 @@ func (s *Sessions) SetCookieBody(id uint64, body *box2d.B2Body) error {
 	return err
 }
 
-func (s *Sessions) SetViewportRequest(id uint64, x, y, xx, yy float32, a float32, t bool) error {
+// SetViewportRequest records the last input of a client. seq numbers it, to
+// tell the client when it is applied.
+func (s *Sessions) SetViewportRequest(id uint64, x, y, xx, yy float32, a float32, t bool, seq uint64) error {
 	_, err := s.ensure(
 		id,
 		func() gameSessionFunc {
 			return func(session *gameSession) (interface{}, error) {
-				session.updateViewportRequest(x, y, xx, yy, a, t)
+				session.updateViewportRequest(x, y, xx, yy, a, t, seq)
 				return nil, nil
 			}
 		}(),
@@ -384,6 +500,96 @@ func (s *Sessions) SetViewportRequest(id uint64, x, y, xx, yy float32, a float32
 	return err
 }
 
+// SetCodec records the name of the codec negotiated by the session connection.
+func (s *Sessions) SetCodec(id uint64, name string) error {
+	_, err := s.ensure(
+		id,
+		func() gameSessionFunc {
+			return func(session *gameSession) (interface{}, error) {
+				session.codec = name
+				return nil, nil
+			}
+		}(),
+		WriteMode)
+	return err
+}
+
+func (s *Sessions) GetCodec(id uint64) (string, error) {
+	name, err := s.ensure(
+		id,
+		func() gameSessionFunc {
+			return func(session *gameSession) (interface{}, error) {
+				return session.codec, nil
+			}
+		}(),
+		ReadMode)
+	if err != nil {
+		return "", err
+	}
+	return name.(string), err
+}
+
+// SetRemoteAddr records the network address of the client of the session.
+func (s *Sessions) SetRemoteAddr(id uint64, addr string) error {
+	_, err := s.ensure(
+		id,
+		func() gameSessionFunc {
+			return func(session *gameSession) (interface{}, error) {
+				session.remoteAddr = addr
+				return nil, nil
+			}
+		}(),
+		WriteMode)
+	return err
+}
+
+// SetTrafficCounter sets where the traffic of the session is read from.
+func (s *Sessions) SetTrafficCounter(id uint64, counter TrafficCounter) error {
+	_, err := s.ensure(
+		id,
+		func() gameSessionFunc {
+			return func(session *gameSession) (interface{}, error) {
+				session.traffic = counter
+				return nil, nil
+			}
+		}(),
+		WriteMode)
+	return err
+}
+
+func (s *Sessions) Info(id uint64) (*SessionInfo, error) {
+	info, err := s.ensure(
+		id,
+		func() gameSessionFunc {
+			return func(session *gameSession) (interface{}, error) {
+				info := &SessionInfo{
+					ID:         session.ID,
+					Username:   session.userName,
+					State:      session.state.String(),
+					Score:      session.getScore(),
+					Codec:      session.codec,
+					RemoteAddr: session.remoteAddr,
+
+					Disconnected: !session.disconnectedAt.IsZero(),
+				}
+				info.RTT = durationMillis(session.latency.srtt)
+				info.Jitter = durationMillis(session.latency.jitter)
+				if session.traffic != nil {
+					info.BytesSent, info.WireBytesSent = session.traffic.Traffic()
+					if info.BytesSent > 0 {
+						info.CompressionRatio = float64(info.WireBytesSent) / float64(info.BytesSent)
+					}
+				}
+				return info, nil
+			}
+		}(),
+		ReadMode)
+	if err != nil {
+		return nil, err
+	}
+	return info.(*SessionInfo), err
+}
+
 func (s *Sessions) SetScore(id uint64, score uint64) error {
 	_, err := s.ensure(
 		id,
@@ -440,6 +646,40 @@ func (s *Sessions) IncScore(id uint64, score uint64) error {
 	return err
 }
 
+// EatFood adds the score of a piece of food eaten by the cookie of a session.
+func (s *Sessions) EatFood(id uint64, score uint64) error {
+	_, err := s.ensure(
+		id,
+		func() gameSessionFunc {
+			return func(session *gameSession) (interface{}, error) {
+				session.incScore(score)
+				session.foodEaten++
+				return nil, nil
+			}
+		}(),
+		WriteMode)
+	return err
+}
+
+// GetGameStats returns the stats of the cookie a session is playing with.
+func (s *Sessions) GetGameStats(id uint64) (GameStats, error) {
+	stats, err := s.ensure(
+		id,
+		func() gameSessionFunc {
+			return func(session *gameSession) (interface{}, error) {
+				if !session.inPlayingState() {
+					return nil, ErrNotPlaying
+				}
+				return GameStats{TimeAlive: time.Since(session.playingSince), FoodEaten: session.foodEaten}, nil
+			}
+		}(),
+		ReadMode)
+	if err != nil {
+		return GameStats{}, err
+	}
+	return stats.(GameStats), nil
+}
+
 func (s *Sessions) ensure(id uint64, fn gameSessionFunc, lockMode uint8) (interface{}, error) {
 	var session *gameSession
 	var found bool
@@ -453,7 +693,7 @@ func (s *Sessions) ensure(id uint64, fn gameSessionFunc, lockMode uint8) (interf
 	}
 
 	if session, found = s.sessions[id]; !found {
-		return nil, errSessionNotFound
+		return nil, ErrSessionNotFound
 	}
 	return fn(session)
 }
@@ -480,6 +720,15 @@ func (s *Sessions) Each(fn func(id uint64) bool) {
 	}
 }
 
+// Flush wakes up the readers of the outboxes with messages held.
+func (s *Sessions) Flush() {
+	s.RLock()
+	for _, session := range s.sessions {
+		session.outbox.Flush()
+	}
+	s.RUnlock()
+}
+
 func (s *Sessions) EachParallel(fn func(id uint64)) {
 
 	s.Lock()
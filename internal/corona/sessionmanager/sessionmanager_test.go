@@ -0,0 +1,59 @@
+package sessionmanager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/x1m3/corona/internal/logger"
+)
+
+func TestSessions_PlayManyTimes(t *testing.T) {
+	s := New(logger.Nop(), 16, time.Second)
+	id := s.Add()
+	assert.NoError(t, s.Login(id, "manolo", nil))
+
+	// Nobody reads the session, and dying must not block.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 300; i++ {
+			if err := s.StartPlaying(id); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := s.StopPlaying(id); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked playing the same session")
+	}
+	assert.NoError(t, s.Close(id))
+}
+
+func TestSessions_Disconnected(t *testing.T) {
+	s := New(logger.Nop(), 1, time.Nanosecond)
+	id := s.Add()
+	assert.NoError(t, s.Login(id, "manolo", nil))
+	assert.NoError(t, s.StartPlaying(id))
+	outbox, err := s.GetOutbox(id)
+	assert.NoError(t, err)
+
+	resumable, err := s.Disconnect(id, outbox)
+	assert.NoError(t, err)
+	assert.True(t, resumable)
+
+	needsUpdate, _, _, err := s.GetViewportRequestEnhanced(id, 0)
+	assert.NoError(t, err)
+	assert.False(t, needsUpdate, "nobody reads the viewports")
+	_, _, _, err = s.Ping(id)
+	assert.Equal(t, ErrDisconnected, err)
+	assert.Equal(t, Closed, outbox.Push("stats"), "messages are dropped without overflowing")
+	assert.Equal(t, Closed, outbox.Push("stats"))
+}
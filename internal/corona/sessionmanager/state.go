@@ -1,8 +1,17 @@
 package sessionmanager
 
+// States contains the names of all session states.
+var States = []string{
+	(&notLoggedState{}).String(),
+	(&loggedState{}).String(),
+	(&playingState{}).String(),
+	(&endGameState{}).String(),
+}
+
 type state interface {
 	mustBeLogged() bool
 	canSendScreenUpdates() bool
+	String() string
 }
 
 type notLoggedState struct{}
@@ -11,6 +20,10 @@ func (s *notLoggedState) mustBeLogged() bool {
 	return false
 }
 
+func (s *notLoggedState) String() string {
+	return "not_logged"
+}
+
 func (s *notLoggedState) canSendScreenUpdates() bool {
 	return false
 }
@@ -21,6 +34,10 @@ func (s *loggedState) mustBeLogged() bool {
 	return true
 }
 
+func (s *loggedState) String() string {
+	return "logged"
+}
+
 func (s *loggedState) canSendScreenUpdates() bool {
 	return false
 }
@@ -31,6 +48,10 @@ func (s *playingState) mustBeLogged() bool {
 	return true
 }
 
+func (s *playingState) String() string {
+	return "playing"
+}
+
 func (s *playingState) canSendScreenUpdates() bool {
 	return true
 }
@@ -41,6 +62,10 @@ func (s *endGameState) mustBeLogged() bool {
 	return true
 }
 
+func (s *endGameState) String() string {
+	return "end_game"
+}
+
 func (s *endGameState) canSendScreenUpdates() bool {
 	return false
 }
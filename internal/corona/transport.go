@@ -1,39 +1,93 @@
 package corona
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 
 	"github.com/x1m3/corona/internal/codec"
+	"github.com/x1m3/corona/internal/logger"
 	"github.com/x1m3/corona/internal/messages"
 )
 
-type connection interface {
+// Connection carries encoded messages between a client and the server. A
+// Transport sends and receives messages through it.
+type Connection interface {
 	io.Closer
 	WriteMessage(data []byte) error
+	// ReadMessage blocks until a message arrives. It can return nil data
+	// for frames that must be ignored.
 	ReadMessage() (p []byte, err error)
 }
 
 type WebsocketConnection struct {
-	messageType int
-	conn        *websocket.Conn
+	messageType          int
+	conn                 *websocket.Conn
+	compressionThreshold int
+	payload              uint64  // bytes passed to WriteMessage
+	wire                 *uint64 // bytes written to the network, if counted
 }
 
-func NewWebsocketConnection(c *websocket.Conn) *WebsocketConnection {
-	return &WebsocketConnection{conn: c, messageType: websocket.TextMessage}
+// NewWebsocketConnection returns a connection that sends and receives text
+// frames, or binary frames if binary is true. If compression was negotiated,
+// messages smaller than compressionThreshold bytes are sent uncompressed.
+//
+// Upgrade the connection using CountingResponseWriter to know the bytes
+// written to the network.
+func NewWebsocketConnection(c *websocket.Conn, binary bool, compressionThreshold int) *WebsocketConnection {
+	conn := &WebsocketConnection{conn: c, messageType: websocket.TextMessage, compressionThreshold: compressionThreshold}
+	if binary {
+		conn.messageType = websocket.BinaryMessage
+	}
+	if counting, ok := c.UnderlyingConn().(*countingConn); ok {
+		conn.wire = counting.written
+	}
+	return conn
 }
 
+// Close tells the peer that the connection is going to be closed and closes it.
 func (c *WebsocketConnection) Close() error {
+	_ = c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
 	return c.conn.Close()
 }
 
 func (c *WebsocketConnection) WriteMessage(data []byte) error {
 	_ = c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-	return c.conn.WriteMessage(c.messageType, data)
+	// It does nothing if compression was not negotiated.
+	c.conn.EnableWriteCompression(len(data) >= c.compressionThreshold)
+
+	var before uint64
+	if c.wire != nil {
+		before = atomic.LoadUint64(c.wire)
+	}
+	if err := c.conn.WriteMessage(c.messageType, data); err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&c.payload, uint64(len(data)))
+	metricWebsocketPayloadBytes.Add(uint64(len(data)))
+	if c.wire != nil {
+		metricWebsocketWireBytes.Add(atomic.LoadUint64(c.wire) - before)
+	}
+	return nil
+}
+
+// Traffic returns the bytes of the messages written and the bytes written to
+// the network, including compression, framing and control frames. The last
+// one is zero if the connection was not upgraded using CountingResponseWriter.
+func (c *WebsocketConnection) Traffic() (payload, wire uint64) {
+	payload = atomic.LoadUint64(&c.payload)
+	if c.wire != nil {
+		wire = atomic.LoadUint64(c.wire)
+	}
+	return payload, wire
 }
 
 func (c *WebsocketConnection) ReadMessage() (p []byte, err error) {
@@ -47,69 +101,217 @@ func (c *WebsocketConnection) ReadMessage() (p []byte, err error) {
 	return data, err
 }
 
+// CountingResponseWriter wraps resp so the connection hijacked from it to
+// upgrade to a websocket counts the bytes written to the network.
+func CountingResponseWriter(resp http.ResponseWriter) http.ResponseWriter {
+	return &countingResponseWriter{ResponseWriter: resp}
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer cannot be hijacked")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &countingConn{Conn: conn, written: new(uint64)}, brw, nil
+}
+
+type countingConn struct {
+	net.Conn
+	written *uint64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddUint64(c.written, uint64(n))
+	return n, err
+}
+
 type Transport struct {
-	conn connection
-	e    codec.MarshalUnmarshaler
+	conn    Connection
+	e       codec.MarshalUnmarshaler
+	log     *logger.Logger
+	batched []messages.Message // received in a batch, not returned yet by Receive
 }
 
-func NewTransport(e codec.MarshalUnmarshaler, c connection) *Transport {
-	return &Transport{e: e, conn: c}
+func NewTransport(e codec.MarshalUnmarshaler, c Connection, log *logger.Logger) *Transport {
+	return &Transport{e: e, conn: c, log: log.With("codec", e.Name())}
 }
 
 func (t *Transport) Send(msg messages.Message) error {
 	data, err := t.marshal(msg)
 	if err != nil {
+		metricMessagesDropped.With("encode").Inc()
+		t.log.Error("Cannot encode message", "msg_type", msg.GetType(), "err", err)
+		return err
+	}
+
+	if err := t.conn.WriteMessage(data); err != nil {
+		metricMessagesDropped.With("write").Inc()
+		return err
+	}
+	metricMessagesSent.With(t.e.Name()).Inc()
+	metricBytesSent.With(t.e.Name()).Add(uint64(len(data)))
+	if t.log.Enabled(logger.DebugLevel) {
+		t.log.Debug("Message sent", "msg_type", msg.GetType(), "bytes", len(data))
+	}
+	return nil
+}
+
+// SendBatch sends msgs in a single frame, as a Batch. The client must support
+// batches. A single message is sent alone.
+func (t *Transport) SendBatch(msgs []messages.Message) error {
+	if len(msgs) == 1 {
+		return t.Send(msgs[0])
+	}
+	items := make([][]byte, 0, len(msgs))
+	for _, msg := range msgs {
+		data, err := t.marshal(msg)
+		if err != nil {
+			metricMessagesDropped.With("encode").Inc()
+			t.log.Error("Cannot encode message", "msg_type", msg.GetType(), "err", err)
+			return err
+		}
+		items = append(items, data)
+	}
+	data, err := t.marshal(messages.NewBatch(items))
+	if err != nil {
+		metricMessagesDropped.With("encode").Add(uint64(len(msgs)))
+		t.log.Error("Cannot encode batch", "messages", len(msgs), "err", err)
 		return err
 	}
 
-	return t.conn.WriteMessage(data)
+	if err := t.conn.WriteMessage(data); err != nil {
+		metricMessagesDropped.With("write").Add(uint64(len(msgs)))
+		return err
+	}
+	metricMessagesSent.With(t.e.Name()).Add(uint64(len(msgs)))
+	metricBytesSent.With(t.e.Name()).Add(uint64(len(data)))
+	metricBatchesSent.Inc()
+	if t.log.Enabled(logger.DebugLevel) {
+		t.log.Debug("Batch sent", "messages", len(msgs), "bytes", len(data))
+	}
+	return nil
 }
 
+// Receive returns the next message. The messages of a batch are returned one
+// by one.
 func (t *Transport) Receive() (messages.Message, error) {
+	if len(t.batched) > 0 {
+		msg := t.batched[0]
+		t.batched = t.batched[1:]
+		return msg, nil
+	}
 	for {
 
 		data, err := t.conn.ReadMessage()
 		if err != nil {
 			return nil, errors.New("bad connection")
 		}
+		if data == nil {
+			// Frame of a type not matching the codec
+			metricMessagesDropped.With("frame_type").Inc()
+			t.log.Warn("Discarding frame of unexpected type")
+			continue
+		}
+		metricMessagesReceived.With(t.e.Name()).Inc()
+		metricBytesReceived.With(t.e.Name()).Add(uint64(len(data)))
 
-		return t.unmarshal(data)
+		msg, err := t.unmarshal(data)
+		if err != nil {
+			metricMessagesDropped.With("decode").Inc()
+			t.log.Warn("Cannot decode message", "bytes", len(data), "err", err)
+			return nil, err
+		}
+		if t.log.Enabled(logger.DebugLevel) {
+			t.log.Debug("Message received", "msg_type", msg.GetType(), "bytes", len(data))
+		}
+		if batch, ok := msg.(*messages.Batch); ok {
+			msgs, err := Unbatch(t.e, batch)
+			if err != nil {
+				metricMessagesDropped.With("decode").Inc()
+				t.log.Warn("Cannot decode batch", "bytes", len(data), "err", err)
+				return nil, err
+			}
+			if len(msgs) == 0 {
+				continue
+			}
+			t.batched = msgs[1:]
+			return msgs[0], nil
+		}
+		return msg, nil
 	}
 }
 
+// Codec returns the codec used to encode and decode messages.
+func (t *Transport) Codec() codec.MarshalUnmarshaler {
+	return t.e
+}
+
 func (t *Transport) Close() error {
 	return t.conn.Close()
 }
 
-func (t *Transport) marshal(data messages.Message) ([]byte, error) {
-	return t.e.Marshal(data)
+// marshal wraps the messages sent by clients in an envelope.
+func (t *Transport) marshal(msg messages.Message) ([]byte, error) {
+	r, found := messages.Lookup(msg.GetType())
+	if !found {
+		return nil, fmt.Errorf("unknown message type <%v>", msg.GetType())
+	}
+	if r.Direction == messages.ClientToServer {
+		return t.e.Marshal(&messages.Envelope{Type: msg.GetType(), Data: msg})
+	}
+	return t.e.Marshal(msg)
 }
 
 func (t *Transport) unmarshal(data []byte) (messages.Message, error) {
-	var msg messages.Message
-	var baseMsg messages.BaseMessage
+	return Decode(t.e, data)
+}
 
-	if err := t.e.Unmarshal(data, &baseMsg); err != nil {
+// Decode returns the message encoded in data with codec c, as a Transport
+// receives it.
+func Decode(c codec.MarshalUnmarshaler, data []byte) (messages.Message, error) {
+	var header messages.Header
+	if err := c.Unmarshal(data, &header); err != nil {
 		return nil, err
 	}
 
-	msgType := baseMsg.GetType()
-	switch msgType {
-	case messages.ViewPortRequestType:
-		msg = &messages.ViewPortRequest{}
-	case messages.ViewPortResponseType:
-		msg = &messages.ViewportResponse{}
-	case messages.UserJoinRequestType:
-		msg = &messages.UserJoinRequest{}
-	case messages.CreateCookieRequestType:
-		msg = &messages.CreateCookieRequest{}
-	default:
-		return nil, fmt.Errorf("unknown message type <%v>", baseMsg.GetType())
+	r, found := messages.Lookup(header.GetType())
+	if !found {
+		return nil, fmt.Errorf("unknown message type <%v>", header.GetType())
 	}
 
-	if err := t.e.Unmarshal(baseMsg.Data, msg); err != nil {
+	msg := r.New()
+	if r.Direction == messages.ClientToServer {
+		if err := c.Unmarshal(data, &messages.Envelope{Data: msg}); err != nil {
+			return nil, err
+		}
+	} else if err := c.Unmarshal(data, msg); err != nil {
 		return nil, err
 	}
-	msg.SetType(msgType)
+	msg.SetType(r.Type)
 	return msg, nil
 }
+
+// Unbatch returns the messages of a batch encoded with codec c.
+func Unbatch(c codec.MarshalUnmarshaler, batch *messages.Batch) ([]messages.Message, error) {
+	msgs := make([]messages.Message, 0, len(batch.Messages))
+	for _, data := range batch.Messages {
+		msg, err := Decode(c, data)
+		if err != nil {
+			return nil, err
+		}
+		if msg.GetType() == messages.BatchType {
+			return nil, errors.New("nested batch")
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
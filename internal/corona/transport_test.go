@@ -1,16 +1,24 @@
 package corona_test
 
 import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/gorilla/websocket"
 
 	"github.com/x1m3/corona/internal/codec"
+	"github.com/x1m3/corona/internal/codec/compact"
 	"github.com/x1m3/corona/internal/codec/json"
 	"github.com/x1m3/corona/internal/codec/msgpack"
 	"github.com/x1m3/corona/internal/corona"
+	"github.com/x1m3/corona/internal/logger"
 	"github.com/x1m3/corona/internal/messages"
 )
 
@@ -39,7 +47,7 @@ func TestTransport_MarshalUnmarshall(t *testing.T) {
 	msg.SetType(messages.ViewPortRequestType)
 
 	for _, codec := range []codec.MarshalUnmarshaler{json.Codec, msgpack.Codec} {
-		transport := corona.NewTransport(codec, &dummyConnection{})
+		transport := corona.NewTransport(codec, &dummyConnection{}, logger.Nop())
 
 		err := transport.Send(msg)
 		assert.NoError(t, err, codec.Name())
@@ -60,7 +68,7 @@ func BenchmarkTransport_MarshalJson(b *testing.B) {
 	msg := &messages.ViewPortRequest{X: 1.0 / 3, Y: 2.0 / 3, XX: 3.0 / 3, YY: 4.0 / 3}
 	msg.SetType(messages.ViewPortRequestType)
 
-	transport := corona.NewTransport(json.Codec, &dummyConnection{})
+	transport := corona.NewTransport(json.Codec, &dummyConnection{}, logger.Nop())
 	for n := 0; n < b.N; n++ {
 		transport.Send(msg)
 	}
@@ -71,8 +79,175 @@ func BenchmarkTransport_MarshalMsgPack(b *testing.B) {
 	msg := &messages.ViewPortRequest{X: 1.0 / 3, Y: 2.0 / 3, XX: 3.0 / 3, YY: 4.0 / 3}
 	msg.SetType(messages.ViewPortRequestType)
 
-	transport := corona.NewTransport(msgpack.Codec, &dummyConnection{})
+	transport := corona.NewTransport(msgpack.Codec, &dummyConnection{}, logger.Nop())
 	for n := 0; n < b.N; n++ {
 		transport.Send(msg)
 	}
 }
+
+func TestTransport_CompactViewport(t *testing.T) {
+	msg := viewport(2, 3)
+	transport := corona.NewTransport(compact.Codec, &dummyConnection{}, logger.Nop())
+
+	assert.NoError(t, transport.Send(msg))
+	recData, err := transport.Receive()
+	assert.NoError(t, err)
+	recMsg, ok := recData.(*messages.ViewportResponse)
+	assert.True(t, ok)
+	assert.Equal(t, msg.GetType(), recMsg.GetType())
+	assert.Len(t, recMsg.Cookies, 2)
+	assert.Len(t, recMsg.Food, 3)
+	assert.Equal(t, msg.Food[2].ID, recMsg.Food[2].ID)
+	assert.InDelta(t, msg.Cookies[1].X, recMsg.Cookies[1].X, 1.0/128)
+}
+
+// viewport returns a response like the ones the world sends.
+func viewport(cookies, food int) *messages.ViewportResponse {
+	r := rand.New(rand.NewSource(1))
+	v := &messages.ViewportResponse{
+		Cookies: make([]*messages.CookieInfo, 0),
+		Food:    make([]*messages.FoodInfo, 0),
+	}
+	v.SetType(messages.ViewPortResponseType)
+	for i := 0; i < cookies; i++ {
+		v.Cookies = append(v.Cookies, &messages.CookieInfo{ID: uint64(r.Intn(10000)), Score: uint64(100 + r.Intn(5000)), X: 500 + r.Float32()*200, Y: 800 + r.Float32()*150})
+	}
+	for i := 0; i < food; i++ {
+		v.Food = append(v.Food, &messages.FoodInfo{ID: r.Uint64() << 8, Score: 1, X: 500 + r.Float32()*200, Y: 800 + r.Float32()*150})
+	}
+	return v
+}
+
+func benchmarkViewport(b *testing.B, c codec.MarshalUnmarshaler) {
+	msg := viewport(20, 300)
+	conn := &dummyConnection{}
+	transport := corona.NewTransport(c, conn, logger.Nop())
+
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		conn.msgs = conn.msgs[:0]
+		if err := transport.Send(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(conn.msgs[0])), "bytes/msg")
+}
+
+func BenchmarkTransport_ViewportJson(b *testing.B) {
+	benchmarkViewport(b, json.Codec)
+}
+
+func BenchmarkTransport_ViewportMsgPack(b *testing.B) {
+	benchmarkViewport(b, msgpack.Codec)
+}
+
+func BenchmarkTransport_ViewportCompact(b *testing.B) {
+	benchmarkViewport(b, compact.Codec)
+}
+
+func TestPipe(t *testing.T) {
+	for _, c := range []codec.MarshalUnmarshaler{json.Codec, msgpack.Codec, compact.Codec} {
+		serverConn, clientConn := corona.Pipe()
+		server := corona.NewTransport(c, serverConn, logger.Nop())
+		client := corona.NewTransport(c, clientConn, logger.Nop())
+
+		assert.NoError(t, client.Send(messages.NewUserJoinRequest("manolo")), c.Name())
+		msg, err := server.Receive()
+		assert.NoError(t, err, c.Name())
+		assert.Equal(t, "manolo", msg.(*messages.UserJoinRequest).Username, c.Name())
+
+		assert.NoError(t, server.Send(messages.NewStatsResponse(10, 2)), c.Name())
+		assert.NoError(t, server.Send(viewport(3, 5)), c.Name())
+		assert.NoError(t, server.Close())
+
+		// Messages written before closing are still delivered.
+		msg, err = client.Receive()
+		assert.NoError(t, err, c.Name())
+		assert.Equal(t, uint64(2), msg.(*messages.StatsResponse).Data.CookiesCount, c.Name())
+		msg, err = client.Receive()
+		assert.NoError(t, err, c.Name())
+		assert.Len(t, msg.(*messages.ViewportResponse).Food, 5, c.Name())
+
+		_, err = client.Receive()
+		assert.Error(t, err, c.Name())
+		assert.Error(t, client.Send(messages.NewCreateCookieRequest()), c.Name())
+	}
+}
+
+func TestTransport_Batch(t *testing.T) {
+	for _, c := range []codec.MarshalUnmarshaler{json.Codec, msgpack.Codec, compact.Codec} {
+		serverConn, clientConn := corona.Pipe()
+		server := corona.NewTransport(c, serverConn, logger.Nop())
+		client := corona.NewTransport(c, clientConn, logger.Nop())
+
+		assert.NoError(t, server.SendBatch([]messages.Message{messages.NewStatsResponse(10, 2), viewport(3, 5), messages.NewPing(1, 0, 0)}), c.Name())
+		assert.NoError(t, server.SendBatch([]messages.Message{messages.NewPing(2, 0, 0)}), c.Name())
+		assert.NoError(t, server.Close())
+
+		data, err := clientConn.ReadMessage()
+		assert.NoError(t, err, c.Name())
+		msg, err := corona.Decode(c, data)
+		assert.NoError(t, err, c.Name())
+		assert.Len(t, msg.(*messages.Batch).Messages, 3, c.Name())
+		msgs, err := corona.Unbatch(c, msg.(*messages.Batch))
+		assert.NoError(t, err, c.Name())
+		assert.Equal(t, uint64(2), msgs[0].(*messages.StatsResponse).Data.CookiesCount, c.Name())
+		assert.Len(t, msgs[1].(*messages.ViewportResponse).Food, 5, c.Name())
+		assert.Equal(t, uint64(1), msgs[2].(*messages.Ping).ID, c.Name())
+
+		// A single message is sent alone.
+		msg, err = client.Receive()
+		assert.NoError(t, err, c.Name())
+		assert.Equal(t, uint64(2), msg.(*messages.Ping).ID, c.Name())
+	}
+}
+
+func TestTransport_ReceiveBatch(t *testing.T) {
+	serverConn, clientConn := corona.Pipe()
+	server := corona.NewTransport(msgpack.Codec, serverConn, logger.Nop())
+	client := corona.NewTransport(msgpack.Codec, clientConn, logger.Nop())
+
+	assert.NoError(t, server.SendBatch([]messages.Message{messages.NewPing(1, 0, 0), messages.NewPing(2, 0, 0)}))
+	assert.NoError(t, server.Send(messages.NewPing(3, 0, 0)))
+	for id := uint64(1); id <= 3; id++ {
+		msg, err := client.Receive()
+		assert.NoError(t, err)
+		assert.Equal(t, id, msg.(*messages.Ping).ID, "batched messages are received one by one, in order")
+	}
+}
+
+func TestWebsocketConnection_Compression(t *testing.T) {
+	conns := make(chan *corona.WebsocketConnection, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		upgrader := websocket.Upgrader{EnableCompression: true}
+		conn, err := upgrader.Upgrade(corona.CountingResponseWriter(resp), req, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		conns <- corona.NewWebsocketConnection(conn, false, 100)
+	}))
+	defer server.Close()
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	client, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.NoError(t, err)
+	defer client.Close()
+	conn := <-conns
+
+	small := []byte(`{"t":7}`)
+	big := bytes.Repeat([]byte(`{"ID":1234,"SC":1,"X":10.5,"Y":20.25},`), 100)
+
+	assert.NoError(t, conn.WriteMessage(small))
+	_, wireBefore := conn.Traffic()
+	assert.NoError(t, conn.WriteMessage(big))
+
+	for _, expected := range [][]byte{small, big} {
+		_, data, err := client.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, data)
+	}
+
+	payload, wire := conn.Traffic()
+	assert.Equal(t, uint64(len(small)+len(big)), payload)
+	assert.True(t, wire-wireBefore < uint64(len(big))/4, "big message took <%d> bytes on the wire", wire-wireBefore)
+}
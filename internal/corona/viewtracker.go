@@ -0,0 +1,161 @@
+package corona
+
+import (
+	"sync"
+
+	"github.com/x1m3/corona/internal/messages"
+)
+
+// viewHistory is the number of frames sent to a client that can be used as
+// the base of a delta.
+const viewHistory = 16
+
+// viewTracker remembers what was sent to a client, so viewport responses only
+// carry the entities that appeared, moved or changed their score since the
+// last frame the client acknowledged, and the ones that left the view.
+//
+// Clients that never acknowledge a frame always get keyframes.
+type viewTracker struct {
+	sync.Mutex
+	frame         uint64 // last frame sent
+	acked         uint64 // last frame acknowledged by the client
+	resync        bool   // the client asked for a keyframe
+	sinceKeyframe int
+	history       [viewHistory]*viewSnapshot
+}
+
+// viewSnapshot is the state of the view of a client once a frame is applied.
+type viewSnapshot struct {
+	frame   uint64
+	cookies map[uint64]messages.CookieInfo
+	food    map[uint64]messages.FoodInfo
+}
+
+// ack records that the client applied frame. If resync is true, the client
+// found a gap and needs a keyframe.
+func (t *viewTracker) ack(frame uint64, resync bool) {
+	t.Lock()
+	if frame <= t.frame && frame > t.acked {
+		t.acked = frame
+	}
+	t.resync = t.resync || resync
+	t.Unlock()
+}
+
+// next numbers resp, that contains the full view, and strips from it what the
+// client already knows. A keyframe is sent every keyframePeriod frames.
+// Entities that moved less than threshold meters are not sent.
+func (t *viewTracker) next(resp *messages.ViewportResponse, keyframePeriod int, threshold float32) *messages.ViewportResponse {
+	t.Lock()
+	defer t.Unlock()
+
+	t.frame++
+	resp.Frame = t.frame
+	snapshot := &viewSnapshot{
+		frame:   t.frame,
+		cookies: make(map[uint64]messages.CookieInfo, len(resp.Cookies)),
+		food:    make(map[uint64]messages.FoodInfo, len(resp.Food)),
+	}
+	t.history[t.frame%viewHistory] = snapshot
+
+	base := t.base(keyframePeriod)
+	if base == nil {
+		resp.Keyframe = true
+		t.sinceKeyframe = 0
+		t.resync = false
+		for _, c := range resp.Cookies {
+			snapshot.cookies[c.ID] = *c
+		}
+		for _, f := range resp.Food {
+			snapshot.food[f.ID] = *f
+		}
+		metricViewportFrames.With("keyframe").Inc()
+		return resp
+	}
+
+	resp.BaseFrame = base.frame
+	t.sinceKeyframe++
+
+	// Unchanged entities keep the values the client has, so small moves add up
+	// until they are over the threshold.
+	cookies := resp.Cookies[:0]
+	for _, c := range resp.Cookies {
+		if old, found := base.cookies[c.ID]; found && old.Score == c.Score && !moved(old.X, old.Y, c.X, c.Y, threshold) {
+			snapshot.cookies[c.ID] = old
+			continue
+		}
+		snapshot.cookies[c.ID] = *c
+		cookies = append(cookies, c)
+	}
+	resp.Cookies = cookies
+
+	food := resp.Food[:0]
+	for _, f := range resp.Food {
+		if old, found := base.food[f.ID]; found && old.Score == f.Score && !moved(old.X, old.Y, f.X, f.Y, threshold) {
+			snapshot.food[f.ID] = old
+			continue
+		}
+		snapshot.food[f.ID] = *f
+		food = append(food, f)
+	}
+	resp.Food = food
+
+	for id := range base.cookies {
+		if _, found := snapshot.cookies[id]; !found {
+			resp.RemovedCookies = append(resp.RemovedCookies, id)
+		}
+	}
+	for id := range base.food {
+		if _, found := snapshot.food[id]; !found {
+			resp.RemovedFood = append(resp.RemovedFood, id)
+		}
+	}
+
+	metricViewportFrames.With("delta").Inc()
+	return resp
+}
+
+// base returns the snapshot a delta can be built on, or nil if a keyframe
+// must be sent.
+func (t *viewTracker) base(keyframePeriod int) *viewSnapshot {
+	if t.acked == 0 || t.resync || t.sinceKeyframe >= keyframePeriod-1 {
+		return nil
+	}
+	s := t.history[t.acked%viewHistory]
+	if s == nil || s.frame != t.acked {
+		return nil
+	}
+	return s
+}
+
+func moved(x1, y1, x2, y2, threshold float32) bool {
+	dx, dy := x2-x1, y2-y1
+	return dx*dx+dy*dy > threshold*threshold
+}
+
+// viewTrackers holds the tracker of every session.
+type viewTrackers struct {
+	sync.Mutex
+	trackers map[uint64]*viewTracker
+}
+
+func newViewTrackers() *viewTrackers {
+	return &viewTrackers{trackers: make(map[uint64]*viewTracker)}
+}
+
+func (v *viewTrackers) get(sessionID uint64) *viewTracker {
+	v.Lock()
+	defer v.Unlock()
+	t, found := v.trackers[sessionID]
+	if !found {
+		t = &viewTracker{}
+		v.trackers[sessionID] = t
+	}
+	return t
+}
+
+func (v *viewTrackers) remove(sessionID uint64) {
+	v.Lock()
+	delete(v.trackers, sessionID)
+	v.Unlock()
+}
@@ -0,0 +1,83 @@
+package corona
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/x1m3/corona/internal/messages"
+)
+
+func view(cookies []messages.CookieInfo, food []messages.FoodInfo) *messages.ViewportResponse {
+	resp := &messages.ViewportResponse{Cookies: make([]*messages.CookieInfo, 0), Food: make([]*messages.FoodInfo, 0)}
+	for i := range cookies {
+		resp.Cookies = append(resp.Cookies, &cookies[i])
+	}
+	for i := range food {
+		resp.Food = append(resp.Food, &food[i])
+	}
+	return resp
+}
+
+func TestViewTracker(t *testing.T) {
+	tracker := &viewTracker{}
+	food := []messages.FoodInfo{{ID: 1, Score: 1, X: 10, Y: 10}, {ID: 2, Score: 1, X: 20, Y: 20}}
+
+	// Without acks, everything is a keyframe.
+	resp := tracker.next(view([]messages.CookieInfo{{ID: 7, Score: 100, X: 5, Y: 5}}, food), 10, 0.1)
+	assert.Equal(t, uint64(1), resp.Frame)
+	assert.True(t, resp.Keyframe)
+	assert.Len(t, resp.Food, 2)
+	resp = tracker.next(view([]messages.CookieInfo{{ID: 7, Score: 100, X: 5, Y: 5}}, food), 10, 0.1)
+	assert.True(t, resp.Keyframe)
+
+	tracker.ack(2, false)
+
+	// Food did not move, the cookie moved less than the threshold and then more.
+	resp = tracker.next(view([]messages.CookieInfo{{ID: 7, Score: 100, X: 5.05, Y: 5}}, food), 10, 0.1)
+	assert.False(t, resp.Keyframe)
+	assert.Equal(t, uint64(2), resp.BaseFrame)
+	assert.Empty(t, resp.Cookies)
+	assert.Empty(t, resp.Food)
+	assert.Empty(t, resp.RemovedFood)
+
+	resp = tracker.next(view([]messages.CookieInfo{{ID: 7, Score: 100, X: 5.2, Y: 5}, {ID: 8, Score: 100, X: 1, Y: 1}}, food[1:]), 10, 0.1)
+	assert.Equal(t, uint64(2), resp.BaseFrame)
+	assert.Len(t, resp.Cookies, 2)
+	assert.Empty(t, resp.Food)
+	assert.Equal(t, []uint64{1}, resp.RemovedFood)
+
+	// Small moves add up against the last acknowledged frame.
+	tracker.ack(3, false)
+	resp = tracker.next(view([]messages.CookieInfo{{ID: 7, Score: 100, X: 5.12, Y: 5}}, food), 10, 0.1)
+	assert.Equal(t, uint64(3), resp.BaseFrame)
+	assert.Len(t, resp.Cookies, 1)
+	assert.Equal(t, float32(5.12), resp.Cookies[0].X)
+
+	// Score changes are always sent.
+	resp = tracker.next(view([]messages.CookieInfo{{ID: 7, Score: 150, X: 5, Y: 5}}, food), 10, 0.1)
+	assert.Len(t, resp.Cookies, 1)
+
+	// Old or unknown acks are ignored, a resync forces a keyframe.
+	tracker.ack(2, false)
+	tracker.ack(1000, false)
+	tracker.ack(0, true)
+	resp = tracker.next(view(nil, food), 10, 0.1)
+	assert.True(t, resp.Keyframe)
+	assert.Len(t, resp.Food, 2)
+
+	tracker.ack(resp.Frame, false)
+	for i := 0; i < 9; i++ {
+		resp = tracker.next(view(nil, food), 10, 0.1)
+		assert.False(t, resp.Keyframe, "frame %d", resp.Frame)
+	}
+	resp = tracker.next(view(nil, food), 10, 0.1)
+	assert.True(t, resp.Keyframe, "keyframe period")
+
+	// An ack too old to be in the history forces a keyframe.
+	for i := 0; i < viewHistory; i++ {
+		tracker.next(view(nil, food), 10, 0.1)
+	}
+	resp = tracker.next(view(nil, food), 10, 0.1)
+	assert.True(t, resp.Keyframe)
+}
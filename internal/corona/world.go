@@ -1,10 +1,9 @@
 package corona
 
 import (
-	"fmt"
-	"log"
 	"math"
 	"math/rand"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,6 +12,7 @@ import (
 
 	"github.com/x1m3/corona/internal/corona/mybox2d"
 	"github.com/x1m3/corona/internal/corona/sessionmanager"
+	"github.com/x1m3/corona/internal/logger"
 	"github.com/x1m3/corona/internal/messages"
 	"github.com/x1m3/corona/pkg/list"
 )
@@ -21,12 +21,17 @@ type world struct {
 	worldMutex sync.RWMutex
 
 	gSessions *sessionmanager.Sessions
+	log       *logger.Logger
 
 	box2d.B2World
 	width  float64
 	height float64
 
 	updateClientPeriod time.Duration
+	keyframePeriod     int
+	deltaThreshold     float32
+	pingPeriod         time.Duration
+	views              *viewTrackers
 
 	minFPS     float64
 	maxFPS     float64
@@ -41,9 +46,19 @@ type world struct {
 	foodCount      uint64
 	bodies2Destroy list.LIFO
 	foodQueue      list.LIFO
+	tick           uint64 // simulation steps run
+	lastTick       int64  // unix nanoseconds of the last step start
+	measuredFPS    uint64 // steps per second really run, as float64 bits
+
+	goroutinesMutex sync.Mutex
+	goroutines      map[string]bool // alive world goroutines by name
+
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
 }
 
-func NewWorld(gs *sessionmanager.Sessions, w, h, minFPS, maxFPS float64, speed, turboSpeed int, minFoodCount uint64, updateClientPeriod time.Duration) *world {
+func NewWorld(gs *sessionmanager.Sessions, log *logger.Logger, cfg Config) *world {
 
 	chColl2Cookies := make(chan *collision2CookiesDTO, 1024)
 	chCollCookieFood := make(chan *collissionCookieFoodDTO, 1024)
@@ -51,19 +66,26 @@ func NewWorld(gs *sessionmanager.Sessions, w, h, minFPS, maxFPS float64, speed,
 	world := &world{
 		B2World:            box2d.MakeB2World(box2d.MakeB2Vec2(0, 0)),
 		gSessions:          gs,
-		width:              w,
-		height:             h,
-		updateClientPeriod: updateClientPeriod,
-		minFPS:             minFPS,
-		maxFPS:             maxFPS,
-		currentFPS:         (maxFPS + minFPS) / 2,
+		log:                log,
+		width:              cfg.Width,
+		height:             cfg.Height,
+		updateClientPeriod: cfg.UpdateClientPeriod,
+		keyframePeriod:     cfg.KeyframePeriod,
+		pingPeriod:         cfg.PingPeriod,
+		deltaThreshold:     float32(cfg.DeltaThreshold),
+		views:              newViewTrackers(),
+		minFPS:             cfg.MinFPS,
+		maxFPS:             cfg.MaxFPS,
+		currentFPS:         (cfg.MaxFPS + cfg.MinFPS) / 2,
 		col2Cookies:        chColl2Cookies,
 		colCookieFood:      chCollCookieFood,
-		speed:              speed,
-		turboSpeed:         turboSpeed,
-		minFoodCount:       minFoodCount,
+		speed:              cfg.Speed,
+		turboSpeed:         cfg.TurboSpeed,
+		minFoodCount:       cfg.MinFoodCount,
+		goroutines:         make(map[string]bool),
+		done:               make(chan struct{}),
 	}
-	world.B2World.SetContactListener(newContactListener(chColl2Cookies, chCollCookieFood))
+	world.B2World.SetContactListener(newContactListener(chColl2Cookies, chCollCookieFood, world.done))
 	return world
 }
 
@@ -101,21 +123,108 @@ func (w *world) createWorld() {
 	createWorldBoundary(&w.B2World, w.width, w.height/2, 0.1, w.height, true)
 }
 
-func (w *world) runSimulation(velocityIterations int, positionIterations int) {
+// run starts the simulation and all the goroutines that depend on it. They
+// keep running until stop is called.
+func (w *world) run(velocityIterations int, positionIterations int) {
+	atomic.StoreInt64(&w.lastTick, time.Now().UnixNano())
+	w.setMeasuredFPS(w.currentFPS)
+
+	w.spawn("simulation", func() { w.runSimulation(velocityIterations, positionIterations) })
+	w.spawn("metrics", func() { w.collectMetrics(time.Second) })
+	w.spawn("food", func() { w.adjustFood(2 * time.Second) })
+	w.spawn("stats", func() { w.broadcastStats(5 * time.Second) })
+	w.spawn("ping", func() { w.ping(w.pingPeriod) })
+	w.spawn("contacts_cookies", w.listenContactBetweenCookies)
+	w.spawn("contacts_food", w.listenContactBetweenCookiesAndFood)
+}
+
+// spawn runs fn in a goroutine tracked by wait and health. A panic in fn is
+// logged and marks the goroutine as dead instead of crashing the server.
+func (w *world) spawn(name string, fn func()) {
+	w.setAlive(name, true)
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				w.log.Error("World goroutine panicked", "goroutine", name, "panic", r, "stack", string(debug.Stack()))
+			}
+			w.setAlive(name, false)
+		}()
+		fn()
+	}()
+}
 
+func (w *world) setAlive(name string, alive bool) {
+	w.goroutinesMutex.Lock()
+	w.goroutines[name] = alive
+	w.goroutinesMutex.Unlock()
+}
+
+func (w *world) health() *Health {
+	h := &Health{
+		Tick:       w.getTick(),
+		FPS:        math.Float64frombits(atomic.LoadUint64(&w.measuredFPS)),
+		MinFPS:     w.minFPS,
+		Goroutines: make(map[string]bool),
+	}
+
+	w.goroutinesMutex.Lock()
+	for name, alive := range w.goroutines {
+		h.Goroutines[name] = alive
+	}
+	w.goroutinesMutex.Unlock()
+
+	if lastTick := atomic.LoadInt64(&w.lastTick); lastTick != 0 {
+		h.LastTickAge = time.Since(time.Unix(0, lastTick))
+		h.Running = true
+		select {
+		case <-w.done:
+			h.Running = false
+		default:
+		}
+	}
+	return h
+}
+
+func (w *world) setMeasuredFPS(fps float64) {
+	atomic.StoreUint64(&w.measuredFPS, math.Float64bits(fps))
+}
+
+// stop signals all world goroutines to finish. Use wait to know when they are done.
+func (w *world) stop() {
+	w.stopOnce.Do(func() {
+		close(w.done)
+	})
+}
+
+func (w *world) wait() {
+	w.wg.Wait()
+}
+
+func (w *world) runSimulation(velocityIterations int, positionIterations int) {
 	timeStep := time.Duration(time.Second / time.Duration(w.currentFPS))
 	timeStepBox2D := float64(timeStep) / float64(time.Second) // Seconds as a float
 	var notime int
+	frame := timeStep.Seconds() // smoothed duration of a full step, sleep included
 
-	go w.adjustFood(2 * time.Second)
-	go w.broadcastStats(5 * time.Second)
-	go w.listenContactBetweenCookies()
-	go w.listenContactBetweenCookiesAndFood()
+	metricFPS.Set(w.currentFPS)
 
 	i := 0
 	for {
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+
 		i++
+		atomic.AddUint64(&w.tick, 1)
 		t1 := time.Now()
+		if last := atomic.SwapInt64(&w.lastTick, t1.UnixNano()); i > 1 {
+			frame = 0.9*frame + 0.1*t1.Sub(time.Unix(0, last)).Seconds()
+			w.setMeasuredFPS(1 / frame)
+		}
 
 		w.worldMutex.Lock()
 
@@ -131,27 +240,33 @@ func (w *world) runSimulation(velocityIterations int, positionIterations int) {
 		}
 
 		w.updateViewportResponses()
+		bodies := w.B2World.GetBodyCount()
 
 		w.worldMutex.Unlock()
 
 		elapsed := time.Since(t1)
+		metricStepDuration.Observe(elapsed.Seconds())
+		metricBodies.Set(float64(bodies))
+
 		if elapsed < timeStep {
 			notime--
 			time.Sleep(timeStep - elapsed)
 		} else {
 			notime++
-			log.Printf("WARNING: Cannot sustain frame rate. Expected time <%v>. Real time <%v>. FPS <%f>", timeStep, elapsed, w.currentFPS)
+			w.log.Warn("Cannot sustain frame rate", "tick", w.getTick(), "expected", timeStep, "elapsed", elapsed, "fps", w.currentFPS)
 		}
 		if notime < -60 && w.currentFPS < w.maxFPS {
-			log.Println("FPS up")
 			w.currentFPS++
+			w.log.Info("FPS up", "tick", w.getTick(), "fps", w.currentFPS)
+			metricFPS.Set(w.currentFPS)
 			timeStep = time.Duration(time.Second / time.Duration(w.currentFPS))
 			timeStepBox2D = float64(timeStep) / float64(time.Second) // Seconds as a float
 			notime = 0
 		}
 		if notime > 0 && w.currentFPS > w.minFPS {
-			log.Println("FPS down")
 			w.currentFPS--
+			w.log.Info("FPS down", "tick", w.getTick(), "fps", w.currentFPS)
+			metricFPS.Set(w.currentFPS)
 			timeStep = time.Duration(time.Second / time.Duration(w.currentFPS))
 			timeStepBox2D = float64(timeStep) / float64(time.Second) // Seconds as a float
 			notime = 0
@@ -169,6 +284,10 @@ func (w *world) adjustSpeedsAndSizes() {
 			return true
 		}
 		body, _ := w.gSessions.GetCookieBody(sessionID)
+		if body == nil {
+			// Exploded since it was checked.
+			return true
+		}
 
 		data := body.GetUserData().(*Cookie)
 
@@ -185,7 +304,7 @@ func (w *world) adjustSpeedsAndSizes() {
 
 		magnitude := 2 * (expectedSpeed - currentSpeed) * inertia * contactPenalty
 
-		viewport, _ := w.gSessions.GetViewportRequest(sessionID)
+		viewport, _ := w.gSessions.ApplyInput(sessionID)
 
 		vector := box2d.MakeB2Vec2(math.Cos(float64(viewport.Angle)), math.Sin(float64(viewport.Angle)))
 
@@ -240,25 +359,108 @@ func (w *world) runFoodTasks() {
 
 }
 
+// throwFood queues a food task to be run by the simulation.
+func (w *world) throwFood(task throwFoodTask) {
+	w.foodQueue.Push(task)
+}
+
+func (w *world) getTick() uint64 {
+	return atomic.LoadUint64(&w.tick)
+}
+
+func (w *world) getMinFoodCount() uint64 {
+	return atomic.LoadUint64(&w.minFoodCount)
+}
+
+func (w *world) setMinFoodCount(n uint64) {
+	atomic.StoreUint64(&w.minFoodCount, n)
+}
+
+func (w *world) collectMetrics(d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+		metricFood.Set(float64(atomic.LoadUint64(&w.foodCount)))
+		metricCollisionQueue.With("cookies").Set(float64(len(w.col2Cookies)))
+		metricCollisionQueue.With("food").Set(float64(len(w.colCookieFood)))
+
+		stats := w.gSessions.Stats()
+		metricResponseQueue.Set(float64(stats.ResponseQueued))
+		for _, state := range sessionmanager.States {
+			metricSessions.With(state).Set(float64(stats.ByState[state]))
+		}
+	}
+}
+
 func (w *world) broadcastStats(d time.Duration) {
 	ticker := time.NewTicker(d)
+	defer ticker.Stop()
 	for {
-		<-ticker.C
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
 		stats := messages.NewStatsResponse(w.foodCount, w.gSessions.Count())
 		w.broadcast(stats)
 	}
 }
 
+// ping starts a round trip time measure on every session whose client
+// supports pings, and sends the client the latency measured so far.
+func (w *world) ping(d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+		w.gSessions.EachParallel(func(id uint64) {
+			if capable, _ := w.gSessions.HasCapability(id, messages.CapabilityPing); !capable {
+				return
+			}
+			pingID, srtt, jitter, err := w.gSessions.Ping(id)
+			if err != nil {
+				return
+			}
+			outbox, err := w.gSessions.GetOutbox(id)
+			if err != nil {
+				return
+			}
+			w.pushed(id, outbox.Push(messages.NewPing(pingID, millis(srtt), millis(jitter))))
+			// Sent right away, as waiting for the end of the step would add to the round trip time.
+			outbox.Flush()
+		})
+	}
+}
+
+func millis(d time.Duration) float32 {
+	return float32(d) / float32(time.Millisecond)
+}
+
 func (w *world) adjustFood(d time.Duration) {
 	const N = 500
 
 	ticker := time.NewTicker(d)
+	defer ticker.Stop()
 	for {
-		<-ticker.C
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
 		foodCount := atomic.LoadUint64(&w.foodCount)
+		minFoodCount := w.getMinFoodCount()
 
-		if foodCount < w.minFoodCount {
-			log.Println("ajustando", foodCount, w.minFoodCount)
+		if foodCount < minFoodCount {
+			w.log.Debug("Throwing food", "food_count", foodCount, "min_food_count", minFoodCount, "thrown", N)
 			for i := 0; i < N; i++ {
 				w.foodQueue.Push(throwFoodTask{count: 1, x: float64(30 + rand.Intn(int(w.width-30))), y: float64(30 + rand.Intn(int(w.width-30)))})
 			}
@@ -318,23 +520,28 @@ func (w *world) addCookieToWorld(x float64, y float64, sessionID uint64, score u
 
 func (w *world) listenContactBetweenCookies() {
 	for {
-		collision := <-w.col2Cookies
+		var collision *collision2CookiesDTO
+		select {
+		case <-w.done:
+			return
+		case collision = <-w.col2Cookies:
+		}
 
 		cookie1, cookie2 := collision.cookie1, collision.cookie2
 		playing1, err := w.gSessions.IsPlaying(cookie1.ID)
 		if err != nil {
-			fmt.Printf("Error on contact, <%s>", err)
+			w.log.Warn("Error on contact between cookies", "session", cookie1.ID, "err", err)
 			continue
 		}
 
 		playing2, err := w.gSessions.IsPlaying(cookie2.ID)
 		if err != nil {
-			fmt.Printf("Error on contact, <%s>", err)
+			w.log.Warn("Error on contact between cookies", "session", cookie2.ID, "err", err)
 			continue
 		}
 
 		if !playing1 || !playing2 {
-			fmt.Println("######################## Colision con cookie que no está jugando ya ################")
+			w.log.Debug("Contact with a cookie that is not playing anymore", "session1", cookie1.ID, "session2", cookie2.ID)
 			continue
 		}
 
@@ -361,22 +568,11 @@ func (w *world) listenContactBetweenCookies() {
 		w.foodQueue.Push(throwFoodTask{count: int(math.Floor(diff)), x: (cookie1.body.GetPosition().X + cookie2.body.GetPosition().X) / 2, y: (cookie1.body.GetPosition().Y + cookie2.body.GetPosition().Y) / 2})
 
 		if newScore1 < 50 {
-			if err := w.gSessions.StopPlaying(cookie1.ID); err != nil {
-				log.Println(err)
-			}
-
-			w.bodies2Destroy.Push(cookie1.body)
-
-			// TODO: Notify explotion
+			w.explode(cookie1, cookie2, uint64(score1))
 			continue
 		}
 		if newScore2 < 50 {
-			if err := w.gSessions.StopPlaying(cookie2.ID); err != nil {
-				log.Println(err)
-			}
-			w.bodies2Destroy.Push(cookie2.body)
-
-			// TODO: Notify explotion
+			w.explode(cookie2, cookie1, uint64(score2))
 			continue
 		}
 
@@ -391,27 +587,61 @@ func (w *world) listenContactBetweenCookies() {
 	}
 }
 
+// explode destroys the cookie of a player, killed by another one. The player
+// gets the stats of the game, and the players that see it, the explosion.
+func (w *world) explode(dead, killer *Cookie, score uint64) {
+	pos := dead.body.GetPosition()
+
+	// Stats are only kept while playing.
+	if stats, err := w.gSessions.GetGameStats(dead.ID); err == nil {
+		var killerName string
+		if info, err := w.gSessions.Info(killer.ID); err == nil {
+			killerName = info.Username
+		}
+		if outbox, err := w.gSessions.GetOutbox(dead.ID); err == nil {
+			w.pushed(dead.ID, outbox.Push(messages.NewCookieDestroyed(killer.ID, killerName, score, stats.TimeAlive, stats.FoodEaten)))
+		}
+	}
+	w.broadcastAt(pos.X, pos.Y, messages.NewDeathEvent(dead.ID, killer.ID, score, float32(pos.X), float32(pos.Y)))
+
+	if err := w.gSessions.StopPlaying(dead.ID); err != nil {
+		w.log.Error("Error stopping game", "session", dead.ID, "err", err)
+	}
+	// The session must not destroy the body again when it is closed.
+	if err := w.gSessions.SetCookieBody(dead.ID, nil); err != nil {
+		w.log.Error("Error removing cookie from session", "session", dead.ID, "err", err)
+	}
+	w.bodies2Destroy.Push(dead.body)
+	metricDeaths.Inc()
+	w.log.Debug("Cookie destroyed", "session", dead.ID, "killer", killer.ID, "score", score)
+}
+
 func (w *world) listenContactBetweenCookiesAndFood() {
 	for {
-		collision := <-w.colCookieFood
+		var collision *collissionCookieFoodDTO
+		select {
+		case <-w.done:
+			return
+		case collision = <-w.colCookieFood:
+		}
 
 		cookie := collision.cookie
 		food := collision.food
 
 		playing, err := w.gSessions.IsPlaying(cookie.ID)
 		if err != nil {
-			fmt.Printf("Error on contact, <%s>", err)
+			w.log.Warn("Error on contact between cookie and food", "session", cookie.ID, "err", err)
 			continue
 		}
 
 		if !playing {
-			fmt.Println("######################## Colision con cookie que no está jugando ya y comida ################")
+			w.log.Debug("Contact between food and a cookie that is not playing anymore", "session", cookie.ID)
 			continue
 		}
 
-		err = w.gSessions.IncScore(cookie.ID, food.Score)
+		err = w.gSessions.EatFood(cookie.ID, food.Score)
 		if err != nil {
-			log.Printf("Error updating score, <%s>", err)
+			w.log.Error("Error updating score", "session", cookie.ID, "err", err)
 		}
 
 		atomic.AddUint64(&w.foodCount, ^uint64(0)) // Decrement 1 :-)
@@ -424,12 +654,22 @@ func (w *world) listenContactBetweenCookiesAndFood() {
 func (w *world) updateViewportResponses() {
 	w.gSessions.EachParallel(
 		func(sessionID uint64) {
-			needsUpdate, v, respCh, err := w.gSessions.GetViewportRequestEnhanced(sessionID, w.updateClientPeriod)
+			needsUpdate, v, outbox, err := w.gSessions.GetViewportRequestEnhanced(sessionID, w.updateClientPeriod)
 			if !needsUpdate || err != nil {
 				return
 			}
-			respCh <- w.viewPort(v)
+			resp := w.viewPort(v)
+			resp.Tick, resp.InputSeq = w.getTick(), v.Processed
+			if body, _ := w.gSessions.GetCookieBody(sessionID); body != nil {
+				velocity := body.GetLinearVelocity()
+				resp.VX, resp.VY = float32(velocity.X), float32(velocity.Y)
+			}
+			// Deltas are built on the last frame acknowledged by the client, so
+			// a pending one can be replaced by the next.
+			w.pushed(sessionID, outbox.Replace(w.views.get(sessionID).next(resp, w.keyframePeriod, w.deltaThreshold)))
 		})
+	// Messages queued in this step are sent together to clients that batch them.
+	w.gSessions.Flush()
 }
 
 func (w *world) viewPort(v *sessionmanager.Viewport) *messages.ViewportResponse {
@@ -474,10 +714,39 @@ func (w *world) viewPort(v *sessionmanager.Viewport) *messages.ViewportResponse
 
 func (w *world) broadcast(message interface{}) {
 	w.gSessions.EachParallel(func(id uint64) {
-		ch, err := w.gSessions.GetResponseChannel(id)
+		outbox, err := w.gSessions.GetOutbox(id)
 		if err != nil {
 			return
 		}
-		ch <- message
+		w.pushed(id, outbox.Push(message))
 	})
 }
+
+// broadcastAt sends a message to the players whose viewport contains x, y.
+func (w *world) broadcastAt(x, y float64, message interface{}) {
+	w.gSessions.EachParallel(func(id uint64) {
+		v, err := w.gSessions.GetViewportRequest(id)
+		if err != nil || x < float64(v.X) || x > float64(v.XX) || y < float64(v.Y) || y > float64(v.YY) {
+			return
+		}
+		outbox, err := w.gSessions.GetOutbox(id)
+		if err != nil {
+			return
+		}
+		w.pushed(id, outbox.Push(message))
+	})
+}
+
+// pushed records what happened to a message pushed to the outbox of a session.
+func (w *world) pushed(sessionID uint64, result sessionmanager.PushResult) {
+	switch result {
+	case sessionmanager.Superseded:
+		metricMessagesDropped.With("superseded").Inc()
+	case sessionmanager.Dropped:
+		metricMessagesDropped.With("outbox_full").Inc()
+	case sessionmanager.Overflowed:
+		metricMessagesDropped.With("outbox_full").Inc()
+		metricOutboxOverflows.Inc()
+		w.log.Warn("Client too slow, closing session", "session", sessionID)
+	}
+}
@@ -0,0 +1,127 @@
+package corona
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/x1m3/corona/internal/logger"
+	"github.com/x1m3/corona/internal/messages"
+)
+
+func TestWorld_Explode(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Logger = logger.Nop()
+	game := New(cfg)
+
+	play := func(name string) (uint64, *Cookie) {
+		id, _ := game.NewSession()
+		_, err := game.UserJoin(id, messages.NewUserJoinRequest(name))
+		assert.NoError(t, err)
+		_, err = game.CreateCookie(id, messages.NewCreateCookieRequest())
+		assert.NoError(t, err)
+		body, err := game.gSessions.GetCookieBody(id)
+		assert.NoError(t, err)
+		return id, body.GetUserData().(*Cookie)
+	}
+	deadID, dead := play("manolo")
+	killerID, killer := play("pepe")
+	for _, id := range []uint64{deadID, killerID} {
+		game.UpdateViewPortRequest(id, messages.NewViewPortRequest(0, 0, float32(cfg.Width), float32(cfg.Height), 0, false))
+	}
+	assert.NoError(t, game.gSessions.EatFood(deadID, 1))
+
+	game.world.explode(dead, killer, 120)
+
+	playing, err := game.gSessions.IsPlaying(deadID)
+	assert.NoError(t, err)
+	assert.False(t, playing, "the player can create a new cookie")
+
+	outbox, _ := game.gSessions.GetOutbox(deadID)
+	msgs, err := outbox.Take()
+	assert.NoError(t, err)
+	if assert.Len(t, msgs, 2) {
+		destroyed := msgs[0].(*messages.CookieDestroyed)
+		assert.Equal(t, killerID, destroyed.Data.KillerID)
+		assert.Equal(t, "pepe", destroyed.Data.KillerName)
+		assert.Equal(t, uint64(120), destroyed.Data.Score)
+		assert.Equal(t, uint64(1), destroyed.Data.FoodEaten)
+		assert.Equal(t, deadID, msgs[1].(*messages.DeathEvent).ID)
+	}
+
+	outbox, _ = game.gSessions.GetOutbox(killerID)
+	msgs, err = outbox.Take()
+	assert.NoError(t, err)
+	if assert.Len(t, msgs, 1) {
+		event := msgs[0].(*messages.DeathEvent)
+		assert.Equal(t, killerID, event.KillerID)
+		assert.Equal(t, float32(dead.body.GetPosition().X), event.X)
+	}
+}
+
+func TestWorld_ExplodeAndKick(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Logger = logger.Nop()
+	game := New(cfg)
+
+	play := func(name string) (uint64, *Cookie) {
+		id, _ := game.NewSession()
+		_, err := game.UserJoin(id, messages.NewUserJoinRequest(name))
+		assert.NoError(t, err)
+		_, err = game.CreateCookie(id, messages.NewCreateCookieRequest())
+		assert.NoError(t, err)
+		body, err := game.gSessions.GetCookieBody(id)
+		assert.NoError(t, err)
+		return id, body.GetUserData().(*Cookie)
+	}
+	deadID, dead := play("manolo")
+	_, killer := play("pepe")
+	before := game.world.B2World.GetBodyCount()
+
+	game.world.explode(dead, killer, 120)
+	assert.NoError(t, game.Kick(deadID))
+	game.world.removeBodies()
+	assert.Equal(t, before-1, game.world.B2World.GetBodyCount(), "the body of a dead cookie is destroyed once")
+}
+
+func TestWorld_ExplodeManyTimes(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Logger = logger.Nop()
+	game := New(cfg)
+
+	killerID, _ := game.NewSession()
+	_, err := game.UserJoin(killerID, messages.NewUserJoinRequest("pepe"))
+	assert.NoError(t, err)
+	_, err = game.CreateCookie(killerID, messages.NewCreateCookieRequest())
+	assert.NoError(t, err)
+	body, _ := game.gSessions.GetCookieBody(killerID)
+	killer := body.GetUserData().(*Cookie)
+
+	deadID, _ := game.NewSession()
+	_, err = game.UserJoin(deadID, messages.NewUserJoinRequest("manolo"))
+	assert.NoError(t, err)
+	before := game.world.B2World.GetBodyCount()
+
+	// Nobody reads the session, and dying must not block the simulation.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 300; i++ {
+			if _, err := game.CreateCookie(deadID, messages.NewCreateCookieRequest()); err != nil {
+				t.Error(err)
+				return
+			}
+			body, _ := game.gSessions.GetCookieBody(deadID)
+			game.world.explode(body.GetUserData().(*Cookie), killer, 120)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked killing the same session")
+	}
+	assert.NoError(t, game.Kick(deadID))
+	game.world.removeBodies()
+	assert.Equal(t, before, game.world.B2World.GetBodyCount())
+}
@@ -0,0 +1,199 @@
+// Package logger contains a levelled logger that writes structured records,
+// a message plus key/value pairs, as text or JSON lines.
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int8
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = map[Level]string{
+	DebugLevel: "debug",
+	InfoLevel:  "info",
+	WarnLevel:  "warn",
+	ErrorLevel: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel returns the level with the given name (debug, info, warn, error).
+func ParseLevel(name string) (Level, error) {
+	for level, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return level, nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("unknown log level <%s>", name)
+}
+
+type Format int8
+
+const (
+	TextFormat Format = iota
+	JSONFormat
+)
+
+// ParseFormat returns the format with the given name (text, json).
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "text":
+		return TextFormat, nil
+	case "json":
+		return JSONFormat, nil
+	}
+	return TextFormat, fmt.Errorf("unknown log format <%s>", name)
+}
+
+// output is shared by a logger and all loggers derived from it with With.
+type output struct {
+	sync.Mutex
+	w      io.Writer
+	level  Level
+	format Format
+}
+
+// Logger writes records with a level, a message and key/value pairs. Keys
+// should be strings. A Logger is safe for concurrent use.
+type Logger struct {
+	out    *output
+	fields []interface{}
+}
+
+// New returns a logger writing records of at least level to w.
+func New(w io.Writer, level Level, format Format) *Logger {
+	return &Logger{out: &output{w: w, level: level, format: format}}
+}
+
+var std = New(os.Stderr, InfoLevel, TextFormat)
+
+// Default returns a logger writing info and higher records as text to stderr.
+func Default() *Logger {
+	return std
+}
+
+// Nop returns a logger that discards everything.
+func Nop() *Logger {
+	return New(ioutil.Discard, ErrorLevel+1, TextFormat)
+}
+
+// With returns a logger that adds the key/value pairs to every record.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Enabled returns true if records of the level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.out.level
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(DebugLevel, msg, kv)
+}
+
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(InfoLevel, msg, kv)
+}
+
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(WarnLevel, msg, kv)
+}
+
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(ErrorLevel, msg, kv)
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(missing)")
+	}
+
+	var b bytes.Buffer
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	if l.out.format == JSONFormat {
+		writeJSON(&b, now, level, msg, fields)
+	} else {
+		writeText(&b, now, level, msg, fields)
+	}
+
+	l.out.Lock()
+	_, _ = l.out.w.Write(b.Bytes())
+	l.out.Unlock()
+}
+
+func writeText(b *bytes.Buffer, now string, level Level, msg string, fields []interface{}) {
+	fmt.Fprintf(b, "%s %-5s %s", now, strings.ToUpper(level.String()), msg)
+	for i := 0; i < len(fields); i += 2 {
+		value := fmt.Sprint(textValue(fields[i+1]))
+		if value == "" || strings.ContainsAny(value, " \"=\n\t") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(b, " %v=%s", fields[i], value)
+	}
+	b.WriteByte('\n')
+}
+
+func writeJSON(b *bytes.Buffer, now string, level Level, msg string, fields []interface{}) {
+	b.WriteString(`{"time":`)
+	writeJSONValue(b, now)
+	b.WriteString(`,"level":`)
+	writeJSONValue(b, level.String())
+	b.WriteString(`,"msg":`)
+	writeJSONValue(b, msg)
+	for i := 0; i < len(fields); i += 2 {
+		b.WriteByte(',')
+		writeJSONValue(b, fmt.Sprint(fields[i]))
+		b.WriteByte(':')
+		writeJSONValue(b, textValue(fields[i+1]))
+	}
+	b.WriteString("}\n")
+}
+
+func writeJSONValue(b *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(data)
+}
+
+// textValue converts values that do not have a good default representation.
+func textValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case error:
+		return value.Error()
+	case time.Duration:
+		return value.String()
+	case fmt.Stringer:
+		return value.String()
+	}
+	return v
+}
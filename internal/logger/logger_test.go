@@ -0,0 +1,48 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger_Text(t *testing.T) {
+	var b bytes.Buffer
+	l := New(&b, InfoLevel, TextFormat).With("session", uint64(1234))
+
+	l.Debug("not written")
+	l.Info("user joined", "username", "manolo el del bombo", "err", errors.New("boom"))
+
+	line := b.String()
+	assert.Equal(t, 1, strings.Count(line, "\n"))
+	assert.Contains(t, line, " INFO  user joined session=1234 username=\"manolo el del bombo\" err=boom\n")
+}
+
+func TestLogger_JSON(t *testing.T) {
+	var b bytes.Buffer
+	l := New(&b, DebugLevel, JSONFormat)
+
+	l.With("session", 1).Warn("slow client", "queued", 10, "odd")
+
+	record := make(map[string]interface{})
+	assert.NoError(t, json.Unmarshal(b.Bytes(), &record))
+	assert.Equal(t, "warn", record["level"])
+	assert.Equal(t, "slow client", record["msg"])
+	assert.Equal(t, float64(1), record["session"])
+	assert.Equal(t, float64(10), record["queued"])
+	assert.Equal(t, "(missing)", record["odd"])
+	assert.NotEmpty(t, record["time"])
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("WARN")
+	assert.NoError(t, err)
+	assert.Equal(t, WarnLevel, level)
+
+	_, err = ParseLevel("verbose")
+	assert.Error(t, err)
+}
@@ -2,6 +2,7 @@ package messages
 
 import (
 	"encoding/json"
+	"time"
 )
 
 type msgType int8
@@ -14,6 +15,14 @@ const (
 	CreateCookieRequestType  = 5
 	CreateCookieResponseType = 6
 	StatsResponseType        = 7
+	PingType                 = 8
+	PongType                 = 9
+	ResumeRequestType        = 10
+	ResumeResponseType       = 11
+	ErrorResponseType        = 12
+	BatchType                = 13
+	CookieDestroyedType      = 14
+	DeathEventType           = 15
 )
 
 type Message interface {
@@ -21,9 +30,56 @@ type Message interface {
 	SetType(msgType)
 }
 
+func init() {
+	Register(ViewPortRequestType, "ViewPortRequest", ClientToServer, func() Message { return &ViewPortRequest{} })
+	Register(ViewPortResponseType, "ViewPortResponse", ServerToClient, func() Message { return &ViewportResponse{} })
+	Register(UserJoinRequestType, "UserJoinRequest", ClientToServer, func() Message { return &UserJoinRequest{} })
+	Register(UserJoinResponseType, "UserJoinResponse", ServerToClient, func() Message { return &UserJoinResponse{} })
+	Register(CreateCookieRequestType, "CreateCookieRequest", ClientToServer, func() Message { return &CreateCookieRequest{} })
+	Register(CreateCookieResponseType, "CreateCookieResponse", ServerToClient, func() Message { return &CreateCookieResponse{} })
+	Register(StatsResponseType, "StatsResponse", ServerToClient, func() Message { return &StatsResponse{} })
+	Register(PingType, "Ping", ServerToClient, func() Message { return &Ping{} })
+	Register(PongType, "Pong", ClientToServer, func() Message { return &Pong{} })
+	Register(ResumeRequestType, "ResumeRequest", ClientToServer, func() Message { return &ResumeRequest{} })
+	Register(ResumeResponseType, "ResumeResponse", ServerToClient, func() Message { return &ResumeResponse{} })
+	Register(ErrorResponseType, "ErrorResponse", ServerToClient, func() Message { return &ErrorResponse{} })
+	Register(BatchType, "Batch", ServerToClient, func() Message { return &Batch{} })
+	Register(CookieDestroyedType, "CookieDestroyed", ServerToClient, func() Message { return &CookieDestroyed{} })
+	Register(DeathEventType, "DeathEvent", ServerToClient, func() Message { return &DeathEvent{} })
+}
+
+// Header is the part of every encoded message that tells its type.
+type Header struct {
+	Type msgType `json:"t"`
+}
+
+func (h *Header) GetType() msgType {
+	return h.Type
+}
+
+func (h *Header) SetType(t msgType) {
+	h.Type = t
+}
+
+// Envelope wraps the messages sent by clients: {"t": type, "d": message}.
+// Messages sent by the server are not wrapped.
+type Envelope struct {
+	Type msgType     `json:"t"`
+	Data interface{} `json:"d"`
+}
+
+// Correlated is implemented by the messages that carry a request ID. Clients
+// may set one on their requests, and the server echoes it on the response,
+// or the ErrorResponse, so they can be matched.
+type Correlated interface {
+	GetRequestID() uint64
+	SetRequestID(uint64)
+}
+
 type BaseMessage struct {
-	Type msgType         `json:"t"`
-	Data json.RawMessage `json:"d,omitempty"`
+	Type      msgType         `json:"t"`
+	Data      json.RawMessage `json:"d,omitempty"`
+	RequestID uint64          `json:"RQ,omitempty"` // Zero if the client did not set it
 }
 
 func (m *BaseMessage) GetType() msgType {
@@ -34,6 +90,25 @@ func (m *BaseMessage) SetType(t msgType) {
 	m.Type = t
 }
 
+func (m *BaseMessage) GetRequestID() uint64 {
+	return m.RequestID
+}
+
+func (m *BaseMessage) SetRequestID(id uint64) {
+	m.RequestID = id
+}
+
+// Correlate sets the request ID of req on resp.
+func Correlate(req, resp Message) {
+	r, ok := req.(Correlated)
+	if !ok {
+		return
+	}
+	if c, ok := resp.(Correlated); ok {
+		c.SetRequestID(r.GetRequestID())
+	}
+}
+
 type ViewPortRequest struct {
 	BaseMessage
 	X     float32 `json:"X"`
@@ -42,6 +117,10 @@ type ViewPortRequest struct {
 	YY    float32 `json:"YY"`
 	Angle float32 `json:"R"`
 	Turbo bool    `json:"T"`
+
+	AckFrame uint64 `json:"A,omitempty"`  // Last viewport frame applied by the client
+	Resync   bool   `json:"RS,omitempty"` // The client missed the base frame of a delta and needs a keyframe
+	Seq      uint64 `json:"S,omitempty"`  // Increases with every input, acknowledged in viewport responses
 }
 
 func NewViewPortRequest(X, Y, XX, YY, Angle float32, turbo bool) *ViewPortRequest {
@@ -50,10 +129,26 @@ func NewViewPortRequest(X, Y, XX, YY, Angle float32, turbo bool) *ViewPortReques
 	return resp
 }
 
+// ViewportResponse contains the entities in the viewport of a client. A
+// keyframe contains all of them. Otherwise, it is a delta to be applied on
+// the view the client had after applying BaseFrame, with only the entities
+// that appeared or changed, and the IDs of those that are no longer visible.
+//
+// Tick, InputSeq and the velocity of the cookie of the client let it predict
+// its movement and correct it.
 type ViewportResponse struct {
 	BaseMessage
-	Cookies []*CookieInfo `json:"C"`
-	Food    []*FoodInfo   `json:"F"`
+	Frame          uint64        `json:"FR,omitempty"`
+	Keyframe       bool          `json:"KF,omitempty"`
+	BaseFrame      uint64        `json:"B,omitempty"`
+	Tick           uint64        `json:"TK,omitempty"` // Simulation step the view was taken at
+	InputSeq       uint64        `json:"S,omitempty"`  // Seq of the last input of the client applied by the simulation
+	VX             float32       `json:"VX,omitempty"` // Velocity of the cookie of the client, in meters per second
+	VY             float32       `json:"VY,omitempty"`
+	Cookies        []*CookieInfo `json:"C"`
+	Food           []*FoodInfo   `json:"F"`
+	RemovedCookies []uint64      `json:"RC,omitempty"`
+	RemovedFood    []uint64      `json:"RF,omitempty"`
 }
 
 type CookieInfo struct {
@@ -100,18 +195,27 @@ func NewCreateCookieResponse(ID uint64, sc uint64, X float32, Y float32) *Create
 
 type UserJoinRequest struct {
 	BaseMessage
-	Username string `json:"UN"`
+	Username     string   `json:"UN"`
+	Version      uint8    `json:"V"`            // Protocol version of the client. Zero for clients that predate versioning
+	Capabilities []string `json:"CP,omitempty"` // Optional features supported by the client
 }
 
+// NewUserJoinRequest returns a request of a client that speaks the current
+// protocol version, with all the capabilities.
 func NewUserJoinRequest(name string) *UserJoinRequest {
-	resp := &UserJoinRequest{Username: name}
+	resp := &UserJoinRequest{Username: name, Version: ProtocolVersion, Capabilities: Capabilities()}
 	resp.SetType(UserJoinRequestType)
 	return resp
 }
 
 type userJoinResponseData struct {
-	Ok       bool     `json:"OK"`
-	AltNames []string `json:"AN"`
+	Ok          bool     `json:"OK"`
+	AltNames    []string `json:"AN"`
+	ResumeToken string   `json:"RT,omitempty"` // Sent in a ResumeRequest to get the session back on a new connection
+
+	Version      uint8    `json:"V"`            // Protocol version to use
+	Capabilities []string `json:"CP,omitempty"` // Optional features supported by both ends
+	Reason       string   `json:"RE,omitempty"` // Why the user was rejected
 }
 
 type UserJoinResponse struct {
@@ -140,3 +244,147 @@ func NewStatsResponse(food uint64, cookies uint64) *StatsResponse {
 	resp.SetType(StatsResponseType)
 	return resp
 }
+
+// Ping is sent periodically to measure the round trip time to the client,
+// that answers with a Pong with the same ID. It carries the round trip time
+// and jitter measured so far, in milliseconds.
+type Ping struct {
+	BaseMessage
+	ID     uint64  `json:"I"`
+	RTT    float32 `json:"RTT"`
+	Jitter float32 `json:"J"`
+}
+
+func NewPing(ID uint64, rtt, jitter float32) *Ping {
+	resp := &Ping{ID: ID, RTT: rtt, Jitter: jitter}
+	resp.SetType(PingType)
+	return resp
+}
+
+type Pong struct {
+	BaseMessage
+	ID uint64 `json:"I"`
+}
+
+func NewPong(ID uint64) *Pong {
+	resp := &Pong{ID: ID}
+	resp.SetType(PongType)
+	return resp
+}
+
+// ResumeRequest attaches the connection to the session that issued the token,
+// if it is still alive.
+type ResumeRequest struct {
+	BaseMessage
+	Token string `json:"RT"`
+}
+
+func NewResumeRequest(token string) *ResumeRequest {
+	resp := &ResumeRequest{Token: token}
+	resp.SetType(ResumeRequestType)
+	return resp
+}
+
+type resumeResponseData struct {
+	Ok          bool       `json:"OK"`
+	Cookie      CookieInfo `json:"C"`  // Zero if the session is not playing
+	ResumeToken string     `json:"RT"` // Replaces the one used to resume
+}
+
+type ResumeResponse struct {
+	BaseMessage
+	Data resumeResponseData `json:"d"`
+}
+
+func NewResumeResponse(ok bool, cookie CookieInfo) *ResumeResponse {
+	resp := &ResumeResponse{Data: resumeResponseData{Ok: ok, Cookie: cookie}}
+	resp.SetType(ResumeResponseType)
+	return resp
+}
+
+// Codes of the errors sent to clients. They are stable, so clients can react
+// to them. The message of an error is only meant to be read by humans.
+const (
+	ErrorCodeInternal        = "internal"
+	ErrorCodeUnknownMessage  = "unknown_message"
+	ErrorCodeSessionNotFound = "session_not_found"
+	ErrorCodeAlreadyLogged   = "already_logged"
+	ErrorCodeNotLogged       = "not_logged"
+	ErrorCodeNotPlaying      = "not_playing"
+)
+
+// ErrorResponse tells the client that a request failed.
+type ErrorResponse struct {
+	BaseMessage
+	Code    string  `json:"C"`
+	Message string  `json:"M"`
+	Request msgType `json:"R"` // Type of the request that failed
+}
+
+func NewErrorResponse(code string, message string, request msgType) *ErrorResponse {
+	resp := &ErrorResponse{Code: code, Message: message, Request: request}
+	resp.SetType(ErrorResponseType)
+	return resp
+}
+
+// Error makes the response usable as an error by Go clients.
+func (r *ErrorResponse) Error() string {
+	return r.Code + ": " + r.Message
+}
+
+// Batch carries several messages sent to the client in a single frame, to
+// clients that support CapabilityBatch. Every item is a message encoded as if
+// it was sent alone.
+type Batch struct {
+	BaseMessage
+	Messages [][]byte `json:"M"`
+}
+
+func NewBatch(msgs [][]byte) *Batch {
+	resp := &Batch{Messages: msgs}
+	resp.SetType(BatchType)
+	return resp
+}
+
+type cookieDestroyedData struct {
+	KillerID   uint64 `json:"K"`
+	KillerName string `json:"KN"`
+	Score      uint64 `json:"SC"` // Before the collision that destroyed the cookie
+	TimeAlive  uint64 `json:"TA"` // Milliseconds since the cookie was created
+	FoodEaten  uint64 `json:"FE"`
+}
+
+// CookieDestroyed tells a player that its cookie was destroyed by another
+// one, with the stats of the game. The player can create a new cookie.
+type CookieDestroyed struct {
+	BaseMessage
+	Data cookieDestroyedData `json:"d"`
+}
+
+func NewCookieDestroyed(killerID uint64, killerName string, score uint64, timeAlive time.Duration, foodEaten uint64) *CookieDestroyed {
+	resp := &CookieDestroyed{Data: cookieDestroyedData{
+		KillerID:   killerID,
+		KillerName: killerName,
+		Score:      score,
+		TimeAlive:  uint64(timeAlive / time.Millisecond),
+		FoodEaten:  foodEaten,
+	}}
+	resp.SetType(CookieDestroyedType)
+	return resp
+}
+
+// DeathEvent tells the players that see it that a cookie exploded.
+type DeathEvent struct {
+	BaseMessage
+	ID       uint64  `json:"ID"`
+	KillerID uint64  `json:"K"`
+	Score    uint64  `json:"SC"`
+	X        float32 `json:"X"`
+	Y        float32 `json:"Y"`
+}
+
+func NewDeathEvent(ID uint64, killerID uint64, score uint64, X float32, Y float32) *DeathEvent {
+	resp := &DeathEvent{ID: ID, KillerID: killerID, Score: score, X: X, Y: Y}
+	resp.SetType(DeathEventType)
+	return resp
+}
@@ -0,0 +1,52 @@
+package messages
+
+import (
+	"fmt"
+)
+
+// Versions of the protocol the server speaks. A client sends its version when
+// joining. Clients older than MinProtocolVersion are rejected, and newer ones
+// are downgraded to ProtocolVersion.
+const (
+	MinProtocolVersion = 1
+	ProtocolVersion    = 1
+)
+
+// Optional features a client can tell it supports when joining. Clients that
+// do not support one of them do not get it.
+const (
+	CapabilityDelta  = "delta"  // viewport responses with only the changes since an acknowledged frame
+	CapabilityPing   = "ping"   // round trip time measures with Ping and Pong
+	CapabilityResume = "resume" // resume tokens to get the session back on a new connection
+	CapabilityBatch  = "batch"  // several messages in a single frame, with Batch
+)
+
+var capabilities = []string{CapabilityDelta, CapabilityPing, CapabilityResume, CapabilityBatch}
+
+// Capabilities returns the optional features the server supports.
+func Capabilities() []string {
+	return append([]string(nil), capabilities...)
+}
+
+// Negotiate checks a client that speaks version with the given capabilities
+// can play. It returns the version to use, and the capabilities supported by
+// both, or an error telling why the client is rejected.
+func Negotiate(version uint8, clientCapabilities []string) (uint8, []string, error) {
+	if version < MinProtocolVersion {
+		return 0, nil, fmt.Errorf("protocol version %d is no longer supported, the server speaks versions %d to %d. Reload the page to update the game", version, MinProtocolVersion, ProtocolVersion)
+	}
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+
+	common := make([]string, 0, len(capabilities))
+	for _, c := range capabilities {
+		for _, cc := range clientCapabilities {
+			if c == cc {
+				common = append(common, c)
+				break
+			}
+		}
+	}
+	return version, common, nil
+}
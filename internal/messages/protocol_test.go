@@ -0,0 +1,23 @@
+package messages_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/x1m3/corona/internal/messages"
+)
+
+func TestNegotiate(t *testing.T) {
+	_, _, err := messages.Negotiate(0, messages.Capabilities())
+	assert.Error(t, err, "clients that predate versioning are rejected")
+
+	version, capabilities, err := messages.Negotiate(messages.ProtocolVersion, []string{messages.CapabilityPing, "teleport"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(messages.ProtocolVersion), version)
+	assert.Equal(t, []string{messages.CapabilityPing}, capabilities, "unknown capabilities are left out")
+
+	version, _, err = messages.Negotiate(messages.ProtocolVersion+1, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(messages.ProtocolVersion), version, "newer clients are downgraded")
+}
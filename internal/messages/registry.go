@@ -0,0 +1,122 @@
+package messages
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Direction tells who sends a message type.
+type Direction int8
+
+const (
+	ClientToServer Direction = iota + 1
+	ServerToClient
+)
+
+func (d Direction) String() string {
+	switch d {
+	case ClientToServer:
+		return "client_to_server"
+	case ServerToClient:
+		return "server_to_client"
+	}
+	return fmt.Sprintf("direction(%d)", int8(d))
+}
+
+// Registration describes a message type.
+type Registration struct {
+	Type      msgType
+	Name      string
+	Direction Direction
+	New       func() Message // returns an empty message, to decode into
+}
+
+var registry = struct {
+	sync.RWMutex
+	types map[msgType]*Registration
+}{types: make(map[msgType]*Registration)}
+
+// Register adds a message type. New messages only need to be registered here,
+// and handled with a Dispatcher if they are sent by clients. It panics if the
+// type or the name were registered before, as it is a programming error.
+func Register(t msgType, name string, direction Direction, ctor func() Message) {
+	registry.Lock()
+	defer registry.Unlock()
+	for _, r := range registry.types {
+		if r.Type == t || r.Name == name {
+			panic(fmt.Sprintf("message type <%d> <%s> registered twice", t, name))
+		}
+	}
+	registry.types[t] = &Registration{Type: t, Name: name, Direction: direction, New: ctor}
+}
+
+// Lookup returns the registration of a message type.
+func Lookup(t msgType) (*Registration, bool) {
+	registry.RLock()
+	r, found := registry.types[t]
+	registry.RUnlock()
+	return r, found
+}
+
+// Registered returns all registrations, sorted by type.
+func Registered() []*Registration {
+	registry.RLock()
+	all := make([]*Registration, 0, len(registry.types))
+	for _, r := range registry.types {
+		all = append(all, r)
+	}
+	registry.RUnlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].Type < all[j].Type })
+	return all
+}
+
+// Types returns the type of every registered message by name.
+func Types() map[string]int {
+	types := make(map[string]int)
+	for _, r := range Registered() {
+		types[r.Name] = int(r.Type)
+	}
+	return types
+}
+
+// ErrNoHandler is returned when dispatching a message nobody handles.
+var ErrNoHandler = errors.New("no handler for message type")
+
+// Handler processes a message sent by the client of a session. resp is sent
+// back to the client if it is not nil.
+type Handler func(sessionID uint64, msg Message) (resp Message, err error)
+
+// Dispatcher routes client messages to the handler of their type.
+type Dispatcher struct {
+	handlers map[msgType]Handler
+}
+
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{handlers: make(map[msgType]Handler)}
+}
+
+// Handle sets the handler of a message type. It panics if the type is not
+// registered as sent by clients or already has a handler.
+func (d *Dispatcher) Handle(t msgType, h Handler) {
+	r, found := Lookup(t)
+	switch {
+	case !found:
+		panic(fmt.Sprintf("message type <%d> is not registered", t))
+	case r.Direction != ClientToServer:
+		panic(fmt.Sprintf("message type <%s> is not sent by clients", r.Name))
+	case d.handlers[t] != nil:
+		panic(fmt.Sprintf("message type <%s> handled twice", r.Name))
+	}
+	d.handlers[t] = h
+}
+
+// Dispatch calls the handler of the message type.
+func (d *Dispatcher) Dispatch(sessionID uint64, msg Message) (Message, error) {
+	h, found := d.handlers[msg.GetType()]
+	if !found {
+		return nil, ErrNoHandler
+	}
+	return h(sessionID, msg)
+}
@@ -0,0 +1,59 @@
+package messages_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/x1m3/corona/internal/messages"
+)
+
+func TestRegistry(t *testing.T) {
+	r, found := messages.Lookup(messages.ViewPortRequestType)
+	assert.True(t, found)
+	assert.Equal(t, "ViewPortRequest", r.Name)
+	assert.Equal(t, messages.ClientToServer, r.Direction)
+	assert.IsType(t, &messages.ViewPortRequest{}, r.New())
+
+	r, found = messages.Lookup(messages.StatsResponseType)
+	assert.True(t, found)
+	assert.Equal(t, messages.ServerToClient, r.Direction)
+
+	_, found = messages.Lookup(100)
+	assert.False(t, found)
+
+	types := messages.Types()
+	assert.Equal(t, messages.UserJoinResponseType, types["UserJoinResponse"])
+	assert.Len(t, types, len(messages.Registered()))
+
+	assert.Panics(t, func() {
+		messages.Register(messages.StatsResponseType, "Other", messages.ServerToClient, nil)
+	})
+}
+
+func TestDispatcher(t *testing.T) {
+	d := messages.NewDispatcher()
+	errJoin := errors.New("join failed")
+	d.Handle(messages.UserJoinRequestType, func(sessionID uint64, msg messages.Message) (messages.Message, error) {
+		if msg.(*messages.UserJoinRequest).Username == "" {
+			return nil, errJoin
+		}
+		return messages.NewUserJoinResponse(true, nil), nil
+	})
+
+	resp, err := d.Dispatch(1, &messages.UserJoinRequest{BaseMessage: messages.BaseMessage{Type: messages.UserJoinRequestType}, Username: "cookie"})
+	assert.NoError(t, err)
+	assert.Equal(t, messages.UserJoinResponseType, int(resp.GetType()))
+
+	_, err = d.Dispatch(1, &messages.UserJoinRequest{BaseMessage: messages.BaseMessage{Type: messages.UserJoinRequestType}})
+	assert.Equal(t, errJoin, err)
+
+	_, err = d.Dispatch(1, &messages.CreateCookieRequest{BaseMessage: messages.BaseMessage{Type: messages.CreateCookieRequestType}})
+	assert.Equal(t, messages.ErrNoHandler, err)
+
+	handler := func(uint64, messages.Message) (messages.Message, error) { return nil, nil }
+	assert.Panics(t, func() { d.Handle(messages.UserJoinRequestType, handler) }, "handled twice")
+	assert.Panics(t, func() { d.Handle(messages.StatsResponseType, handler) }, "server to client")
+	assert.Panics(t, func() { d.Handle(100, handler) }, "not registered")
+}
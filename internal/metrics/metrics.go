@@ -0,0 +1,336 @@
+// Package metrics contains counters, gauges and histograms that can be exposed
+// using the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default is the registry used by the game packages.
+var Default = NewRegistry()
+
+// Metric is implemented by all the metric types of this package.
+type Metric interface {
+	name() string
+	help() string
+	kind() string
+	write(w io.Writer)
+}
+
+// Registry is a set of metrics. It is an http.Handler that serves them.
+type Registry struct {
+	sync.RWMutex
+	metrics map[string]Metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]Metric)}
+}
+
+// Register adds metrics to the registry. It panics if a metric with the same
+// name was registered before, as it is a programming error.
+func (r *Registry) Register(ms ...Metric) {
+	r.Lock()
+	defer r.Unlock()
+	for _, m := range ms {
+		if _, found := r.metrics[m.name()]; found {
+			panic(fmt.Sprintf("metric <%s> registered twice", m.name()))
+		}
+		r.metrics[m.name()] = m
+	}
+}
+
+// WriteTo writes all metrics, sorted by name, in the Prometheus text format.
+func (r *Registry) WriteTo(out io.Writer) (int64, error) {
+	r.RLock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	cw := &countingWriter{w: bufio.NewWriter(out)}
+	for _, name := range names {
+		m := r.metrics[name]
+		fmt.Fprintf(cw, "# HELP %s %s\n", m.name(), strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(m.help()))
+		fmt.Fprintf(cw, "# TYPE %s %s\n", m.name(), m.kind())
+		m.write(cw)
+	}
+	r.RUnlock()
+
+	if err := cw.w.(*bufio.Writer).Flush(); err != nil {
+		return cw.n, err
+	}
+	return cw.n, cw.err
+}
+
+func (r *Registry) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = r.WriteTo(resp)
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+type desc struct {
+	metricName string
+	metricHelp string
+}
+
+func (d desc) name() string {
+	return d.metricName
+}
+
+func (d desc) help() string {
+	return d.metricHelp
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	desc
+	value uint64
+}
+
+func NewCounter(name, help string) *Counter {
+	return &Counter{desc: desc{metricName: name, metricHelp: help}}
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) kind() string {
+	return "counter"
+}
+
+func (c *Counter) write(w io.Writer) {
+	fmt.Fprintf(w, "%s %d\n", c.metricName, c.Value())
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	desc
+	bits uint64
+}
+
+func NewGauge(name, help string) *Gauge {
+	return &Gauge{desc: desc{metricName: name, metricHelp: help}}
+}
+
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+func (g *Gauge) kind() string {
+	return "gauge"
+}
+
+func (g *Gauge) write(w io.Writer) {
+	fmt.Fprintf(w, "%s %s\n", g.metricName, formatFloat(g.Value()))
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	desc
+	upperBounds []float64
+	counts      []uint64 // one per bucket, plus +Inf
+	count       uint64
+	sumBits     uint64
+}
+
+// NewHistogram returns a histogram with the given bucket upper bounds, that
+// must be sorted in increasing order.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return &Histogram{
+		desc:        desc{metricName: name, metricHelp: help},
+		upperBounds: buckets,
+		counts:      make([]uint64, len(buckets)+1),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upperBounds, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) kind() string {
+	return "histogram"
+}
+
+func (h *Histogram) write(w io.Writer) {
+	var cumulative uint64
+	for i, upperBound := range h.upperBounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.metricName, formatFloat(upperBound), cumulative)
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.upperBounds)])
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.metricName, cumulative)
+	fmt.Fprintf(w, "%s_sum %s\n", h.metricName, formatFloat(math.Float64frombits(atomic.LoadUint64(&h.sumBits))))
+	fmt.Fprintf(w, "%s_count %d\n", h.metricName, atomic.LoadUint64(&h.count))
+}
+
+// vec holds one metric per combination of label values.
+type vec struct {
+	desc
+	labels []string
+	sync.RWMutex
+	children map[string]*child
+}
+
+type child struct {
+	labels string // formatted as {name="value",...}
+	metric interface{}
+}
+
+func newVec(name, help string, labels []string) vec {
+	return vec{desc: desc{metricName: name, metricHelp: help}, labels: labels, children: make(map[string]*child)}
+}
+
+// get returns the metric for the label values, calling create if it does not exist yet.
+func (v *vec) get(values []string, create func() interface{}) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric <%s> expects %d label values, got %d", v.metricName, len(v.labels), len(values)))
+	}
+	k := strings.Join(values, "\xff")
+
+	v.RLock()
+	c, found := v.children[k]
+	v.RUnlock()
+	if found {
+		return c.metric
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	if c, found = v.children[k]; !found {
+		pairs := make([]string, len(values))
+		for i, value := range values {
+			pairs[i] = fmt.Sprintf("%s=\"%s\"", v.labels[i], escapeLabel(value))
+		}
+		c = &child{labels: "{" + strings.Join(pairs, ",") + "}", metric: create()}
+		v.children[k] = c
+	}
+	return c.metric
+}
+
+// sorted returns the children sorted by label values.
+func (v *vec) sorted() []*child {
+	v.RLock()
+	defer v.RUnlock()
+
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	children := make([]*child, len(keys))
+	for i, k := range keys {
+		children[i] = v.children[k]
+	}
+	return children
+}
+
+// CounterVec is a set of counters with the same name and different label values.
+type CounterVec struct {
+	vec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{vec: newVec(name, help, labels)}
+}
+
+// With returns the counter for the label values, in the same order as the labels.
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.get(values, func() interface{} { return NewCounter(c.metricName, c.metricHelp) }).(*Counter)
+}
+
+func (c *CounterVec) kind() string {
+	return "counter"
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	for _, ch := range c.sorted() {
+		fmt.Fprintf(w, "%s%s %d\n", c.metricName, ch.labels, ch.metric.(*Counter).Value())
+	}
+}
+
+// GaugeVec is a set of gauges with the same name and different label values.
+type GaugeVec struct {
+	vec
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{vec: newVec(name, help, labels)}
+}
+
+// With returns the gauge for the label values, in the same order as the labels.
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return g.get(values, func() interface{} { return NewGauge(g.metricName, g.metricHelp) }).(*Gauge)
+}
+
+func (g *GaugeVec) kind() string {
+	return "gauge"
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	for _, ch := range g.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", g.metricName, ch.labels, formatFloat(ch.metric.(*Gauge).Value()))
+	}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
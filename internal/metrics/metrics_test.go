@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	r := NewRegistry()
+
+	c := NewCounter("test_requests_total", "Requests served.")
+	g := NewGauge("test_fps", "Frames per second.")
+	h := NewHistogram("test_step_seconds", "Step duration.", []float64{0.01, 0.1})
+	cv := NewCounterVec("test_bytes_total", "Bytes by codec.", "codec")
+	gv := NewGaugeVec("test_sessions", "Sessions by state.", "state")
+	r.Register(c, g, h, cv, gv)
+
+	c.Add(3)
+	g.Set(42.5)
+	h.Observe(0.005)
+	h.Observe(0.05)
+	h.Observe(1)
+	cv.With("msgpack").Add(10)
+	cv.With("json").Inc()
+	gv.With(`we"ird`).Set(1)
+
+	var b strings.Builder
+	_, err := r.WriteTo(&b)
+	assert.NoError(t, err)
+
+	expected := `# HELP test_bytes_total Bytes by codec.
+# TYPE test_bytes_total counter
+test_bytes_total{codec="json"} 1
+test_bytes_total{codec="msgpack"} 10
+# HELP test_fps Frames per second.
+# TYPE test_fps gauge
+test_fps 42.5
+# HELP test_requests_total Requests served.
+# TYPE test_requests_total counter
+test_requests_total 3
+# HELP test_sessions Sessions by state.
+# TYPE test_sessions gauge
+test_sessions{state="we\"ird"} 1
+# HELP test_step_seconds Step duration.
+# TYPE test_step_seconds histogram
+test_step_seconds_bucket{le="0.01"} 1
+test_step_seconds_bucket{le="0.1"} 2
+test_step_seconds_bucket{le="+Inf"} 3
+test_step_seconds_sum 1.055
+test_step_seconds_count 3
+`
+	assert.Equal(t, expected, b.String())
+}
+
+func TestRegistry_RegisterTwice(t *testing.T) {
+	r := NewRegistry()
+	r.Register(NewCounter("test", ""))
+	assert.Panics(t, func() { r.Register(NewGauge("test", "")) })
+}
@@ -0,0 +1,103 @@
+// Package recording records the frames of a connection to reproduce client
+// sessions later. A recording is a stream of JSON frames, one per line.
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/x1m3/corona/internal/corona"
+	"github.com/x1m3/corona/internal/logger"
+)
+
+// Directions of a frame.
+const (
+	In  = "in"  // received from the client
+	Out = "out" // sent to the client
+)
+
+// Frame is a message sent or received through a connection, as it was on the wire.
+type Frame struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"dir"`
+	Codec     string    `json:"codec"`
+	Data      []byte    `json:"data"`
+}
+
+// Connection records every frame read or written through a connection.
+type Connection struct {
+	corona.Connection
+	codec string
+	log   *logger.Logger
+
+	mu  sync.Mutex
+	w   io.WriteCloser
+	enc *json.Encoder
+	err error // recording stops on the first error
+}
+
+// NewConnection returns conn, recording its frames, encoded with the codec
+// named codecName, to w. w is closed when the connection is closed.
+func NewConnection(conn corona.Connection, codecName string, w io.WriteCloser, log *logger.Logger) *Connection {
+	return &Connection{Connection: conn, codec: codecName, log: log, w: w, enc: json.NewEncoder(w)}
+}
+
+func (c *Connection) WriteMessage(data []byte) error {
+	if err := c.Connection.WriteMessage(data); err != nil {
+		return err
+	}
+	c.record(Out, data)
+	return nil
+}
+
+func (c *Connection) ReadMessage() ([]byte, error) {
+	data, err := c.Connection.ReadMessage()
+	if err != nil || data == nil {
+		return data, err
+	}
+	c.record(In, data)
+	return data, nil
+}
+
+func (c *Connection) Close() error {
+	err := c.Connection.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.w != nil {
+		if closeErr := c.w.Close(); closeErr != nil {
+			c.log.Warn("Cannot close recording", "err", closeErr)
+		}
+		c.w = nil
+	}
+	return err
+}
+
+func (c *Connection) record(direction string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil || c.w == nil {
+		return
+	}
+	c.err = c.enc.Encode(&Frame{Time: time.Now(), Direction: direction, Codec: c.codec, Data: data})
+	if c.err != nil {
+		c.log.Warn("Cannot record frame. Recording stopped", "err", c.err)
+	}
+}
+
+// Read returns the frames recorded in r.
+func Read(r io.Reader) ([]*Frame, error) {
+	frames := make([]*Frame, 0)
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		frame := &Frame{}
+		if err := dec.Decode(frame); err == io.EOF {
+			return frames, nil
+		} else if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+}
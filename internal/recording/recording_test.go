@@ -0,0 +1,53 @@
+package recording_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/x1m3/corona/internal/codec/msgpack"
+	"github.com/x1m3/corona/internal/corona"
+	"github.com/x1m3/corona/internal/logger"
+	"github.com/x1m3/corona/internal/messages"
+	"github.com/x1m3/corona/internal/recording"
+)
+
+type buffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *buffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestConnection(t *testing.T) {
+	serverConn, clientConn := corona.Pipe()
+	out := &buffer{}
+	server := corona.NewTransport(msgpack.Codec, recording.NewConnection(serverConn, msgpack.Codec.Name(), out, logger.Nop()), logger.Nop())
+	client := corona.NewTransport(msgpack.Codec, clientConn, logger.Nop())
+
+	assert.NoError(t, client.Send(messages.NewUserJoinRequest("manolo")))
+	_, err := server.Receive()
+	assert.NoError(t, err)
+	assert.NoError(t, server.Send(messages.NewUserJoinResponse(true, nil)))
+	assert.NoError(t, server.Close())
+	assert.True(t, out.closed)
+
+	frames, err := recording.Read(out)
+	assert.NoError(t, err)
+	assert.Len(t, frames, 2)
+	assert.Equal(t, recording.In, frames[0].Direction)
+	assert.Equal(t, recording.Out, frames[1].Direction)
+	assert.Equal(t, "msgpack", frames[1].Codec)
+	assert.False(t, frames[1].Time.Before(frames[0].Time))
+
+	msg, err := corona.Decode(msgpack.Codec, frames[0].Data)
+	assert.NoError(t, err)
+	assert.Equal(t, "manolo", msg.(*messages.UserJoinRequest).Username)
+	msg, err = corona.Decode(msgpack.Codec, frames[1].Data)
+	assert.NoError(t, err)
+	assert.True(t, msg.(*messages.UserJoinResponse).Data.Ok)
+}
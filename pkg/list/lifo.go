@@ -1,7 +1,10 @@
 package list
 
-// LIFO is a Last In First Out list
+import "sync"
+
+// LIFO is a Last In First Out list. It is safe for concurrent use.
 type LIFO struct {
+	mu   sync.Mutex
 	next *node
 }
 
@@ -10,11 +13,15 @@ func NewLIFO() *LIFO {
 }
 
 func (l *LIFO) Push(data interface{}) {
+	l.mu.Lock()
 	i := &node{data: data, next: l.next}
 	l.next = i
+	l.mu.Unlock()
 }
 
 func (l *LIFO) Pop() interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	if l.next == nil {
 		return nil
 	}
@@ -21,3 +21,25 @@ func TestLIFO_PushPop(t *testing.T) {
 	// List is empty
 	assert.Equal(t, nil, l.Pop())
 }
+
+func TestLIFO_Concurrent(t *testing.T) {
+	const N = 1000
+
+	l := NewLIFO()
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < N; i++ {
+			l.Push(i)
+		}
+		close(done)
+	}()
+
+	popped := 0
+	for popped < N {
+		if l.Pop() != nil {
+			popped++
+		}
+	}
+	<-done
+	assert.Equal(t, nil, l.Pop())
+}